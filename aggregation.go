@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	AggregationMedian     = "median"
+	AggregationMean       = "mean"
+	AggregationSum        = "sum"
+	AggregationPercentile = "percentile"
+	AggregationEWMA       = "ewma"
+	AggregationActiveDays = "active_days"
+)
+
+// Aggregation reduces the daily scores of the tracked days of a user to a single value.
+type Aggregation struct {
+	// Function is one of median, mean, sum, percentile, ewma or active_days.
+	Function string
+	// Parameter is the percentile (0-100) for percentile and the smoothing factor (0-1) for ewma.
+	Parameter float64
+}
+
+func (a Aggregation) String() string {
+	switch a.Function {
+	case AggregationPercentile, AggregationEWMA:
+		return fmt.Sprintf("%s %g", a.Function, a.Parameter)
+	case "":
+		return AggregationMedian
+	default:
+		return a.Function
+	}
+}
+
+// parseAggregation parses an aggregation like "median", "percentile 90" or "ewma 0.3".
+func parseAggregation(value string) (Aggregation, error) {
+	fields := strings.Fields(strings.ToLower(value))
+	if len(fields) == 0 {
+		return Aggregation{Function: AggregationMedian}, nil
+	}
+
+	aggregation := Aggregation{Function: fields[0]}
+	switch aggregation.Function {
+	case AggregationMedian, AggregationMean, AggregationSum, AggregationActiveDays:
+		if len(fields) != 1 {
+			return Aggregation{}, fmt.Errorf("%s takes no parameter", aggregation.Function)
+		}
+	case AggregationPercentile, AggregationEWMA:
+		if len(fields) != 2 {
+			return Aggregation{}, fmt.Errorf("%s requires a parameter", aggregation.Function)
+		}
+		parameter, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return Aggregation{}, err
+		}
+		if aggregation.Function == AggregationPercentile && (parameter < 0 || parameter > 100) {
+			return Aggregation{}, fmt.Errorf("percentile has to be between 0 and 100")
+		}
+		if aggregation.Function == AggregationEWMA && (parameter <= 0 || parameter > 1) {
+			return Aggregation{}, fmt.Errorf("smoothing factor has to be between 0 and 1")
+		}
+		aggregation.Parameter = parameter
+	default:
+		return Aggregation{}, fmt.Errorf("unknown aggregation %q", aggregation.Function)
+	}
+	return aggregation, nil
+}
+
+// apply aggregates the daily scores, entries start with today like returned by MetricStore.window.
+func (a Aggregation) apply(entries []int64) float64 {
+	if len(entries) == 0 {
+		return 0
+	}
+
+	switch a.Function {
+	case AggregationMean:
+		return float64(sum(entries)) / float64(len(entries))
+	case AggregationSum:
+		return float64(sum(entries))
+	case AggregationPercentile:
+		sorted := slices.Sorted(slices.Values(entries))
+		rank := int(math.Ceil(a.Parameter / 100 * float64(len(sorted))))
+		return float64(sorted[min(max(rank-1, 0), len(sorted)-1)])
+	case AggregationEWMA:
+		value := float64(entries[len(entries)-1])
+		for i := len(entries) - 2; i >= 0; i-- {
+			value = a.Parameter*float64(entries[i]) + (1-a.Parameter)*value
+		}
+		return value
+	case AggregationActiveDays:
+		days := 0
+		for _, v := range entries {
+			if v > 0 {
+				days++
+			}
+		}
+		return float64(days)
+	default:
+		sorted := slices.Sorted(slices.Values(entries))
+		if len(sorted)%2 == 0 {
+			return float64((sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2)
+		}
+		return float64(sorted[len(sorted)/2])
+	}
+}
+
+func sum(entries []int64) int64 {
+	var total int64 = 0
+	for _, v := range entries {
+		total += v
+	}
+	return total
+}
+
+// aggregate applies the aggregation to the windows of all users.
+func aggregate(windows map[string][]int64, aggregation Aggregation) map[string]float64 {
+	values := map[string]float64{}
+	for user, entries := range windows {
+		values[user] = aggregation.apply(entries)
+	}
+	return values
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	AnnouncementsOff     = "off"
+	AnnouncementsDM      = "dm"
+	AnnouncementsChannel = "channel"
+)
+
+var announcementDeliveries = []string{AnnouncementsOff, AnnouncementsDM, AnnouncementsChannel}
+
+type AnnouncementSettings struct {
+	// Delivery is either off, dm or channel.
+	Delivery string
+	// Channel receives the announcements if they are delivered to a channel.
+	Channel string
+	// Template is the message sent when a member gains a role, {user}, {role} and {score} are replaced.
+	Template string
+}
+
+func defaultAnnouncementSettings() AnnouncementSettings {
+	return AnnouncementSettings{
+		Delivery: AnnouncementsOff,
+		Template: "Congratulations {user}, you earned the **{role}** role with a score of {score}!",
+	}
+}
+
+func formatAnnouncementSettings(announcements AnnouncementSettings) string {
+	switch announcements.Delivery {
+	case AnnouncementsDM:
+		return "**Announcements:** via DM"
+	case AnnouncementsChannel:
+		return fmt.Sprintf("**Announcements:** in <#%s>", announcements.Channel)
+	default:
+		return "**Announcements:** off"
+	}
+}
+
+// announcement fills the template with the user mention, the role name and the score.
+func (a AnnouncementSettings) announcement(guild string, change RoleChange) string {
+	roleName := "new"
+	if role := cachedRole(guild, change.Role); role != nil {
+		roleName = role.Name
+	}
+	return strings.NewReplacer(
+		"{user}", fmt.Sprintf("<@%s>", change.User),
+		"{role}", roleName,
+		"{score}", strconv.FormatFloat(change.Score, 'f', -1, 64),
+	).Replace(a.Template)
+}
+
+// announceRewards congratulates the members who gained a role unless they opted out.
+func announceRewards(guild string, state *RewardState, changes []RoleChange) {
+	announcements := guildSettings(guild).Announcements
+	if announcements.Delivery == AnnouncementsOff || announcements.Template == "" {
+		return
+	}
+
+	for _, change := range changes {
+		if !change.Add || state.optedOut(change.User) {
+			continue
+		}
+
+		channel := announcements.Channel
+		if announcements.Delivery == AnnouncementsDM {
+			dm, err := dg.UserChannelCreate(change.User)
+			if err != nil {
+				log.Printf("Failed to open DM with %s: %e", change.User, err)
+				continue
+			}
+			channel = dm.ID
+		}
+		if channel == "" {
+			return
+		}
+
+		_, err := dg.ChannelMessageSendComplex(channel, &discordgo.MessageSend{
+			Content: announcements.announcement(guild, change),
+			AllowedMentions: &discordgo.MessageAllowedMentions{
+				Users: []string{change.User},
+			},
+		})
+		if err != nil {
+			log.Printf("Failed to announce role %s of %s: %e", change.Role, change.User, err)
+		}
+	}
+}
+
+func (r *RewardState) optedOut(user string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.OptOut[user]
+}
+
+func (r *RewardState) setOptOut(user string, optOut bool) {
+	r.mutex.Lock()
+	if optOut {
+		r.OptOut[user] = true
+	} else {
+		delete(r.OptOut, user)
+	}
+	r.mutex.Unlock()
+
+	r.store()
+}
+
+func init() {
+	maps.Copy(commands, map[*discordgo.ApplicationCommand]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+		{
+			Name:        "reward_announcements",
+			Description: "Choose whether you are congratulated when you earn a reward role.",
+			Type:        discordgo.ChatApplicationCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "enabled",
+					Description: "Whether to receive announcements",
+					Required:    true,
+				},
+			},
+		}: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			enabled := i.ApplicationCommandData().Options[0].BoolValue()
+			guildRewardState(i.GuildID).setOptOut(i.Member.User.ID, !enabled)
+
+			content := "You will no longer be congratulated on new reward roles."
+			if enabled {
+				content = "You will be congratulated on new reward roles."
+			}
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Content: content,
+					Flags:   discordgo.MessageFlagsEphemeral,
+				},
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		},
+	})
+
+	maps.Copy(messageComponents, map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+		"edit_announcements": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			announcements := guildSettings(i.GuildID).Announcements
+
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseModal,
+				Data: &discordgo.InteractionResponseData{
+					Title: "Edit Announcements",
+					Components: []discordgo.MessageComponent{
+						scoringTextInput("Delivery (off, dm or channel)", "delivery", announcements.Delivery),
+						discordgo.ActionsRow{
+							Components: []discordgo.MessageComponent{
+								discordgo.TextInput{
+									Label:       "Template",
+									Placeholder: "{user}, {role} and {score} are replaced",
+									Style:       discordgo.TextInputParagraph,
+									Value:       announcements.Template,
+									Required:    true,
+									MaxLength:   1000,
+									CustomID:    "template",
+								},
+							},
+						},
+					},
+					CustomID: "edit_announcements",
+				},
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		},
+		"set_announcement_channel": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			err := updateGuildSettings(i.GuildID, func(settings *GuildSettings) error {
+				settings.Announcements.Channel = i.MessageComponentData().Values[0]
+				settings.Announcements.Delivery = AnnouncementsChannel
+				return nil
+			})
+			if err != nil {
+				return
+			}
+
+			updateSettingsMessage(s, i)
+		},
+	})
+
+	maps.Copy(modals, map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, ids []string){
+		"edit_announcements": func(s *discordgo.Session, i *discordgo.InteractionCreate, ids []string) {
+			delivery := strings.ToLower(strings.TrimSpace(i.ModalSubmitData().Components[0].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value))
+			template := i.ModalSubmitData().Components[1].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value
+			if !slices.Contains(announcementDeliveries, delivery) {
+				return
+			}
+			err := updateGuildSettings(i.GuildID, func(settings *GuildSettings) error {
+				if delivery == AnnouncementsChannel && settings.Announcements.Channel == "" {
+					return fmt.Errorf("no announcement channel set")
+				}
+				settings.Announcements.Delivery = delivery
+				settings.Announcements.Template = template
+				return nil
+			})
+			if err != nil {
+				return
+			}
+
+			updateSettingsMessage(s, i)
+		},
+	})
+}
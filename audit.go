@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// maxRewardHistory limits the number of reward events kept per user.
+const maxRewardHistory = 50
+
+// auditMessageLength keeps the audit messages below the message length limit.
+const auditMessageLength = 1900
+
+// RewardEvent is a reward role change applied to a member.
+type RewardEvent struct {
+	Time time.Time
+	Role string
+	Add  bool
+}
+
+func (e RewardEvent) String() string {
+	if e.Add {
+		return fmt.Sprintf("<t:%d:f> gained <@&%s>", e.Time.Unix(), e.Role)
+	}
+	return fmt.Sprintf("<t:%d:f> lost <@&%s>", e.Time.Unix(), e.Role)
+}
+
+// record appends the applied role changes to the history of the users.
+func (r *RewardState) record(changes []RoleChange, now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, change := range changes {
+		events := append(r.History[change.User], RewardEvent{Time: now, Role: change.Role, Add: change.Add})
+		if len(events) > maxRewardHistory {
+			events = events[len(events)-maxRewardHistory:]
+		}
+		r.History[change.User] = events
+	}
+}
+
+// history returns a copy of the reward events of the user, newest first.
+func (r *RewardState) history(user string) []RewardEvent {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	events := make([]RewardEvent, 0, len(r.History[user]))
+	for i := len(r.History[user]) - 1; i >= 0; i-- {
+		events = append(events, r.History[user][i])
+	}
+	return events
+}
+
+// postAuditLog posts the applied role changes to the audit channel of the guild, batched into as few messages as possible.
+func postAuditLog(guild string, changes []RoleChange) {
+	channel := guildSettings(guild).AuditChannel
+	if channel == "" || len(changes) == 0 {
+		return
+	}
+
+	var messages []string
+	var msg strings.Builder
+	for _, change := range changes {
+		var line string
+		if change.Add {
+			line = fmt.Sprintf("➕ <@%s> gained <@&%s>\n", change.User, change.Role)
+		} else {
+			line = fmt.Sprintf("➖ <@%s> lost <@&%s>\n", change.User, change.Role)
+		}
+		if msg.Len()+len(line) > auditMessageLength {
+			messages = append(messages, msg.String())
+			msg.Reset()
+		}
+		msg.WriteString(line)
+	}
+	messages = append(messages, msg.String())
+
+	for _, content := range messages {
+		_, err := dg.ChannelMessageSendComplex(channel, &discordgo.MessageSend{
+			Content:         content,
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		})
+		if err != nil {
+			log.Printf("Failed to post audit log of guild %s: %e", guild, err)
+			return
+		}
+	}
+}
+
+func init() {
+	maps.Copy(commands, map[*discordgo.ApplicationCommand]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+		{
+			Name: "Alice Reward History",
+			Type: discordgo.UserApplicationCommand,
+		}: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			user := i.ApplicationCommandData().TargetID
+			// members may look up their own history, only admins the one of others
+			if i.Member == nil || i.Member.User == nil || (user != i.Member.User.ID && i.Member.Permissions&discordgo.PermissionAdministrator == 0) {
+				err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Content: "You can only look up your own reward history.",
+						Flags:   discordgo.MessageFlagsEphemeral,
+					},
+				})
+				if err != nil {
+					log.Println(err)
+				}
+				return
+			}
+
+			events := guildRewardState(i.GuildID).history(user)
+
+			var msg strings.Builder
+			msg.WriteString(fmt.Sprintf("## Reward History of <@%s>\n", user))
+			if len(events) == 0 {
+				msg.WriteString("No reward roles were changed yet.")
+			}
+			for _, event := range events {
+				line := fmt.Sprintf("* %s\n", event)
+				if msg.Len()+len(line) > auditMessageLength {
+					break
+				}
+				msg.WriteString(line)
+			}
+
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Content:         msg.String(),
+					AllowedMentions: &discordgo.MessageAllowedMentions{},
+					Flags:           discordgo.MessageFlagsEphemeral,
+				},
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		},
+	})
+
+	maps.Copy(messageComponents, map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+		"toggle_audit_channel": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			channel := i.MessageComponentData().Values[0]
+			err := updateGuildSettings(i.GuildID, func(settings *GuildSettings) error {
+				if settings.AuditChannel == channel {
+					settings.AuditChannel = ""
+				} else {
+					settings.AuditChannel = channel
+				}
+				return nil
+			})
+			if err != nil {
+				return
+			}
+
+			updateSettingsMessage(s, i)
+		},
+	})
+}
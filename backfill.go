@@ -0,0 +1,356 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var runningBackfills = struct {
+	mutex  sync.Mutex
+	Guilds map[string]bool
+}{
+	Guilds: map[string]bool{},
+}
+
+type backfillProgress struct {
+	channel      int
+	channels     int
+	messages     int
+	rateLimited  bool
+	lastReported time.Time
+}
+
+func (p *backfillProgress) String() string {
+	status := fmt.Sprintf("Backfilling metrics... channel %d/%d, %d messages scanned.", p.channel, p.channels, p.messages)
+	if p.rateLimited {
+		status += " Waiting for rate limit..."
+	}
+	return status
+}
+
+// fetchMessages requests a page of channel messages and waits on its own when rate limited,
+// so the progress report can show that the backfill is waiting.
+func fetchMessages(s *discordgo.Session, channel string, before string, progress *backfillProgress, report func()) ([]*discordgo.Message, error) {
+	for {
+		messages, err := s.ChannelMessages(channel, 100, before, "", "", discordgo.WithRetryOnRatelimit(false))
+		var rateLimit *discordgo.RateLimitError
+		if !errors.As(err, &rateLimit) {
+			return messages, err
+		}
+
+		progress.rateLimited = true
+		report()
+		time.Sleep(rateLimit.RetryAfter)
+		progress.rateLimited = false
+	}
+}
+
+// backfillMessage is a message of the history earning points, kept to replay the spam detection.
+type backfillMessage struct {
+	author    string
+	content   string
+	timestamp time.Time
+	date      string
+	points    int64
+}
+
+// backfillSeries are the series rebuilt by a backfill.
+var backfillSeries = []string{SeriesMessages, SeriesThreads}
+
+// backfillThreads returns the threads of the channels which are matched by the filter, active ones and public archived ones
+// archived since oldest. Private archived threads are not listed, that requires the bot to manage threads.
+func backfillThreads(s *discordgo.Session, guild string, filter *ChannelFilter, channels []*discordgo.Channel, oldest time.Time) ([]*discordgo.Channel, error) {
+	active, err := s.GuildThreadsActive(guild)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the active threads: %w", err)
+	}
+	var threads []*discordgo.Channel
+	seen := map[string]bool{}
+	add := func(thread *discordgo.Channel) {
+		// a thread archived while listing can show up twice
+		if !seen[thread.ID] && filter.matchCachedChannel(thread) {
+			seen[thread.ID] = true
+			threads = append(threads, thread)
+		}
+	}
+	for _, thread := range active.Threads {
+		add(thread)
+	}
+
+	for _, channel := range channels {
+		switch channel.Type {
+		case discordgo.ChannelTypeGuildText, discordgo.ChannelTypeGuildNews, discordgo.ChannelTypeGuildForum, discordgo.ChannelTypeGuildMedia:
+		default:
+			continue
+		}
+
+		var before *time.Time
+		for {
+			archived, err := s.ThreadsArchived(channel.ID, before, 100)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch the archived threads of channel <#%s>: %w", channel.ID, err)
+			}
+			outOfWindow := false
+			for _, thread := range archived.Threads {
+				if thread.ThreadMetadata == nil {
+					continue
+				}
+				// threads are listed by archive time, newest first
+				if thread.ThreadMetadata.ArchiveTimestamp.Before(oldest) {
+					outOfWindow = true
+					break
+				}
+				before = &thread.ThreadMetadata.ArchiveTimestamp
+				add(thread)
+			}
+			if outOfWindow || !archived.HasMore || before == nil {
+				break
+			}
+		}
+	}
+	return threads, nil
+}
+
+// backfillMetrics rebuilds the message and thread metrics of a track from the message history of all channels and threads of the track.
+// Messages sent while the backfill is running are counted as usual and kept.
+func backfillMetrics(s *discordgo.Session, guild string, track string, report func(progress *backfillProgress)) (int, error) {
+	settings := guildSettings(guild)
+	metrics := trackMetrics(guild, track)
+
+	// messages of the history contain no member, the exclusions are checked against the cached member roles
+	if err := guildMembers(guild).ensureLoaded(s); err != nil {
+		return 0, fmt.Errorf("failed to load the members: %w", err)
+	}
+
+	start := time.Now()
+	location := settings.location()
+	oldestDay := start.In(location).AddDate(0, 0, 1-settings.NumTrackedDays)
+	oldestDay = time.Date(oldestDay.Year(), oldestDay.Month(), oldestDay.Day(), 0, 0, 0, 0, location)
+	oldest := oldestDay.Format(dateFormat)
+
+	metrics.mutex.Lock()
+	snapshots := map[string]DailyPoints{}
+	for _, series := range backfillSeries {
+		snapshot := DailyPoints{}
+		for user, days := range metrics.Series[series] {
+			snapshot[user] = maps.Clone(days)
+		}
+		snapshots[series] = snapshot
+	}
+	metrics.mutex.Unlock()
+
+	filter := &settings.track(track).metricChannelFilter
+	var channels []*discordgo.Channel
+	for _, id := range filter.cachedChannels() {
+		if c := messageChannel(s, id); c != nil {
+			channels = append(channels, c)
+		}
+	}
+	threads, err := backfillThreads(s, guild, filter, channels, oldestDay)
+	if err != nil {
+		return 0, err
+	}
+
+	progress := &backfillProgress{channels: len(channels) + len(threads)}
+	reportThrottled := func() {
+		if time.Since(progress.lastReported) > 2*time.Second {
+			progress.lastReported = time.Now()
+			report(progress)
+		}
+	}
+
+	count := 0
+	var scored []backfillMessage
+	data := map[string]DailyPoints{}
+	for _, series := range backfillSeries {
+		data[series] = DailyPoints{}
+	}
+	for i, channel := range append(channels, threads...) {
+		progress.channel = i + 1
+		reportThrottled()
+
+		// forums have no messages of their own, their posts are threads
+		if channel.Type == discordgo.ChannelTypeGuildForum || channel.Type == discordgo.ChannelTypeGuildMedia {
+			continue
+		}
+
+		before := ""
+		for {
+			batch, err := fetchMessages(s, channel.ID, before, progress, func() { report(progress) })
+			if err != nil {
+				return 0, fmt.Errorf("failed to fetch messages of channel <#%s>: %w", channel.ID, err)
+			}
+			if len(batch) == 0 {
+				break
+			}
+			before = batch[len(batch)-1].ID
+			progress.messages += len(batch)
+
+			outOfWindow := false
+			for _, m := range batch {
+				if m.Timestamp.After(start) {
+					continue
+				}
+				date := m.Timestamp.In(location).Format(dateFormat)
+				if date < oldest {
+					outOfWindow = true
+					break
+				}
+				if m.Author == nil || m.Author.ID == s.State.User.ID {
+					continue
+				}
+				if m.WebhookID != "" && settings.Exclusions.IgnoreBots {
+					continue
+				}
+				if settings.Exclusions.excludesCached(guild, m.Author.ID) || (m.Author.Bot && settings.Exclusions.IgnoreBots) {
+					continue
+				}
+				if points := settings.Scoring.score(m, channel); points != 0 {
+					scored = append(scored, backfillMessage{
+						author:    m.Author.ID,
+						content:   m.Content,
+						timestamp: m.Timestamp,
+						date:      date,
+						points:    points,
+					})
+				}
+				if channel.IsThread() {
+					data[SeriesThreads].add(m.Author.ID, date, 1)
+				}
+				count++
+			}
+			if outOfWindow || len(batch) < 100 {
+				break
+			}
+			reportThrottled()
+		}
+	}
+
+	// replay the spam detection in the order the messages were sent, so spam suppressed when it was sent earns no points
+	slices.SortFunc(scored, func(a, b backfillMessage) int {
+		return a.timestamp.Compare(b.timestamp)
+	})
+	replay := &MetricStore{}
+	for _, m := range scored {
+		if replay.allowPoints(settings.Spam, m.author, m.content, m.timestamp) {
+			data[SeriesMessages].add(m.author, m.date, m.points)
+		}
+	}
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	// keep the points accrued while the backfill was running
+	for _, series := range backfillSeries {
+		for user, days := range metrics.Series[series] {
+			for date, points := range days {
+				delta := points - snapshots[series][user][date]
+				if delta > 0 {
+					data[series].add(user, date, delta)
+				}
+			}
+		}
+		metrics.Series[series] = data[series]
+	}
+	return count, nil
+}
+
+func init() {
+	maps.Copy(commands, map[*discordgo.ApplicationCommand]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+		{
+			Name:                     "alice_backfill",
+			Description:              "Rebuilds the metrics from the message history of the tracked channels and threads.",
+			Type:                     discordgo.ChatApplicationCommand,
+			DefaultMemberPermissions: i64(0),
+			Options: []*discordgo.ApplicationCommandOption{
+				trackOption(),
+			},
+		}: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			track := commandTrack(i)
+			if _, ok := guildSettings(i.GuildID).Tracks[track]; !ok {
+				err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Content: fmt.Sprintf("There is no track named %s.", track),
+						Flags:   discordgo.MessageFlagsEphemeral,
+					},
+				})
+				if err != nil {
+					log.Println(err)
+				}
+				return
+			}
+
+			runningBackfills.mutex.Lock()
+			running := runningBackfills.Guilds[i.GuildID]
+			runningBackfills.Guilds[i.GuildID] = true
+			runningBackfills.mutex.Unlock()
+
+			if running {
+				err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseChannelMessageWithSource,
+					Data: &discordgo.InteractionResponseData{
+						Content: "A backfill is already running.",
+						Flags:   discordgo.MessageFlagsEphemeral,
+					},
+				})
+				if err != nil {
+					log.Println(err)
+				}
+				return
+			}
+
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Flags: discordgo.MessageFlagsEphemeral,
+				},
+			})
+			if err != nil {
+				log.Println(err)
+			}
+
+			finished := func() {
+				runningBackfills.mutex.Lock()
+				delete(runningBackfills.Guilds, i.GuildID)
+				runningBackfills.mutex.Unlock()
+			}
+			edit := func(content string) {
+				_, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+					Content: &content,
+				})
+				if err != nil {
+					log.Println(err)
+				}
+			}
+
+			// run with the scheduler, so shutting down waits for the backfill before saving the metrics
+			started := scheduler.background(func() {
+				defer finished()
+
+				log.Printf("Backfilling metrics of track %s of guild %s...", track, i.GuildID)
+				count, err := backfillMetrics(s, i.GuildID, track, func(progress *backfillProgress) {
+					edit(progress.String())
+				})
+				if err != nil {
+					log.Printf("Failed to backfill metrics of track %s of guild %s: %e", track, i.GuildID, err)
+					edit(fmt.Sprintf("Backfill failed: %s", err))
+					return
+				}
+				log.Printf("Backfilled metrics of track %s of guild %s from %d messages.", track, i.GuildID, count)
+				edit(fmt.Sprintf("Backfill done, rebuilt metrics from %d messages.", count))
+			})
+			if !started {
+				finished()
+				edit("The bot is shutting down, try again later.")
+			}
+		},
+	})
+}
@@ -2,22 +2,64 @@ package main
 
 import (
 	"log"
+	"path"
+	"slices"
+	"strings"
+	"sync"
 
 	"github.com/bwmarrin/discordgo"
 	mapset "github.com/deckarep/golang-set/v2"
 )
 
+// ChannelFilter selects the channels counted for metrics. Threads and forum posts are matched like their
+// parent channel and channels like their category, unless they are excluded themselves.
 type ChannelFilter struct {
 	IncludeCategories mapset.Set[string]
-	IncludeChannels   mapset.Set[string]
-	ExcludeChannels   mapset.Set[string]
-	cache             mapset.Set[string]
+	// IncludeChannels may contain text, announcement, forum, voice and stage channels.
+	IncludeChannels mapset.Set[string]
+	// ExcludeChannels may contain categories and threads as well.
+	ExcludeChannels mapset.Set[string]
+	// IncludePatterns and ExcludePatterns are case-insensitive globs matched against the channel name.
+	IncludePatterns mapset.Set[string]
+	ExcludePatterns mapset.Set[string]
+	cache           *channelCache
+}
+
+// channelCache contains the channels matched by a filter and is shared by all copies of the filter.
+type channelCache struct {
+	mutex    sync.RWMutex
+	channels mapset.Set[string]
+}
+
+// cached returns the matched channels or nil if they were not determined yet.
+func (f *ChannelFilter) cached() mapset.Set[string] {
+	if f.cache == nil {
+		return nil
+	}
+	f.cache.mutex.RLock()
+	defer f.cache.mutex.RUnlock()
+
+	return f.cache.channels
+}
+
+// clone deep copies the rules of the filter.
+func (f *ChannelFilter) clone() ChannelFilter {
+	return ChannelFilter{
+		IncludeCategories: f.IncludeCategories.Clone(),
+		IncludeChannels:   f.IncludeChannels.Clone(),
+		ExcludeChannels:   f.ExcludeChannels.Clone(),
+		IncludePatterns:   f.IncludePatterns.Clone(),
+		ExcludePatterns:   f.ExcludePatterns.Clone(),
+		cache:             f.cache,
+	}
 }
 
 type SerializedChannelFilter struct {
 	IncludeCategories []string `toml:",multiline"`
 	IncludeChannels   []string `toml:",multiline"`
 	ExcludeChannels   []string `toml:",multiline"`
+	IncludePatterns   []string `toml:",multiline"`
+	ExcludePatterns   []string `toml:",multiline"`
 }
 
 func (f *ChannelFilter) ToSerialized() *SerializedChannelFilter {
@@ -25,15 +67,24 @@ func (f *ChannelFilter) ToSerialized() *SerializedChannelFilter {
 		IncludeCategories: f.IncludeCategories.ToSlice(),
 		IncludeChannels:   f.IncludeChannels.ToSlice(),
 		ExcludeChannels:   f.ExcludeChannels.ToSlice(),
+		IncludePatterns:   f.IncludePatterns.ToSlice(),
+		ExcludePatterns:   f.ExcludePatterns.ToSlice(),
 	}
 }
 
-func (f *SerializedChannelFilter) ToUnserialized() ChannelFilter {
-	var filter = ChannelFilter{
+func newChannelFilter() ChannelFilter {
+	return ChannelFilter{
 		IncludeCategories: mapset.NewSet[string](),
 		IncludeChannels:   mapset.NewSet[string](),
 		ExcludeChannels:   mapset.NewSet[string](),
+		IncludePatterns:   mapset.NewSet[string](),
+		ExcludePatterns:   mapset.NewSet[string](),
+		cache:             &channelCache{},
 	}
+}
+
+func (f *SerializedChannelFilter) ToUnserialized() ChannelFilter {
+	var filter = newChannelFilter()
 	if f != nil {
 		if f.IncludeCategories != nil {
 			filter.IncludeCategories = mapset.NewSet[string](f.IncludeCategories...)
@@ -44,6 +95,12 @@ func (f *SerializedChannelFilter) ToUnserialized() ChannelFilter {
 		if f.ExcludeChannels != nil {
 			filter.ExcludeChannels = mapset.NewSet[string](f.ExcludeChannels...)
 		}
+		if f.IncludePatterns != nil {
+			filter.IncludePatterns = mapset.NewSet[string](f.IncludePatterns...)
+		}
+		if f.ExcludePatterns != nil {
+			filter.ExcludePatterns = mapset.NewSet[string](f.ExcludePatterns...)
+		}
 	}
 
 	return filter
@@ -61,8 +118,23 @@ func (f *ChannelFilter) matchID(channel string) bool {
 	return false
 }
 
+// matchPattern checks whether the name matches any of the globs.
+func matchPattern(patterns mapset.Set[string], name string) bool {
+	name = strings.ToLower(name)
+	for pattern := range patterns.Iter() {
+		if ok, err := path.Match(strings.ToLower(pattern), name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchChannel checks a channel which is not a thread against the rules.
 func (f *ChannelFilter) matchChannel(channel *discordgo.Channel) bool {
-	if f.ExcludeChannels.Contains(channel.ID) {
+	if f.ExcludeChannels.Contains(channel.ID) || f.ExcludeChannels.Contains(channel.ParentID) {
+		return false
+	}
+	if matchPattern(f.ExcludePatterns, channel.Name) {
 		return false
 	}
 
@@ -74,35 +146,78 @@ func (f *ChannelFilter) matchChannel(channel *discordgo.Channel) bool {
 		return true
 	}
 
-	return false
+	return matchPattern(f.IncludePatterns, channel.Name)
 }
 
 func (f *ChannelFilter) matchCachedID(channel string) bool {
-	if f.cache != nil {
-		return f.cache.Contains(channel)
+	if cache := f.cached(); cache != nil {
+		return cache.Contains(channel)
 	} else {
 		return f.matchID(channel)
 	}
 }
 
 func (f *ChannelFilter) matchCachedChannel(channel *discordgo.Channel) bool {
-	if f.cache != nil {
-		return f.cache.Contains(channel.ID)
+	if channel.IsThread() {
+		if f.ExcludeChannels.Contains(channel.ID) || matchPattern(f.ExcludePatterns, channel.Name) {
+			return false
+		}
+		return f.matchCachedID(channel.ParentID)
+	}
+	if cache := f.cached(); cache != nil {
+		return cache.Contains(channel.ID)
 	} else {
 		return f.matchChannel(channel)
 	}
 }
 
-func (f *ChannelFilter) updateCache(dg *discordgo.Session) {
+// formatPatterns lists the globs for the settings message.
+func formatPatterns(patterns mapset.Set[string]) string {
+	sorted := patterns.ToSlice()
+	slices.Sort(sorted)
+	return strings.Join(sorted, ", ")
+}
+
+// parsePatterns reads comma or newline separated globs and drops invalid ones.
+func parsePatterns(value string) mapset.Set[string] {
+	patterns := mapset.NewSet[string]()
+	for _, pattern := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		pattern = strings.TrimSpace(pattern)
+		if _, err := path.Match(pattern, ""); pattern == "" || err != nil {
+			continue
+		}
+		patterns.Add(pattern)
+	}
+	return patterns
+}
+
+// cachedChannels returns the IDs of all channels of the guild matched by the filter.
+func (f *ChannelFilter) cachedChannels() []string {
+	cache := f.cached()
+	if cache == nil {
+		return f.IncludeChannels.Difference(f.ExcludeChannels).ToSlice()
+	}
+	return cache.ToSlice()
+}
+
+func (f *ChannelFilter) updateCache(dg *discordgo.Session, guild string) {
 	channels, err := dg.GuildChannels(guild)
 	if err != nil {
-		log.Panicln("Error getting guild channels: %v", err)
+		log.Printf("Error getting channels of guild %s: %v", guild, err)
+		return
 	}
 
-	f.cache = mapset.NewSet[string]()
+	cache := mapset.NewSet[string]()
 	for _, channel := range channels {
+		if channel.Type == discordgo.ChannelTypeGuildCategory {
+			continue
+		}
 		if f.matchChannel(channel) {
-			f.cache.Add(channel.ID)
+			cache.Add(channel.ID)
 		}
 	}
+
+	f.cache.mutex.Lock()
+	f.cache.channels = cache
+	f.cache.mutex.Unlock()
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+type ExclusionSettings struct {
+	// Users neither earn points nor take part in the ranking.
+	Users []string
+	// Roles exclude all of their members, e.g. moderators.
+	Roles []string
+	// IgnoreBots excludes all bots and webhooks.
+	IgnoreBots bool
+}
+
+func defaultExclusionSettings() ExclusionSettings {
+	return ExclusionSettings{
+		Users:      []string{},
+		Roles:      []string{},
+		IgnoreBots: true,
+	}
+}
+
+func (e ExclusionSettings) clone() ExclusionSettings {
+	e.Users = slices.Clone(e.Users)
+	e.Roles = slices.Clone(e.Roles)
+	return e
+}
+
+// excludes checks whether a user with the given roles is excluded from metrics and rewards.
+func (e *ExclusionSettings) excludes(user string, bot bool, roles []string) bool {
+	if bot && e.IgnoreBots {
+		return true
+	}
+	if slices.Contains(e.Users, user) {
+		return true
+	}
+	for _, role := range roles {
+		if slices.Contains(e.Roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludesMember checks the exclusion of a member as sent with an event, falling back to the member cache
+// if the event contains no member.
+func (e *ExclusionSettings) excludesMember(guild string, user *discordgo.User, member *discordgo.Member) bool {
+	if member != nil {
+		return e.excludes(user.ID, user.Bot, member.Roles)
+	}
+	return e.excludesCached(guild, user.ID) || (user.Bot && e.IgnoreBots)
+}
+
+// excludesCached checks the exclusion of a user based on the member cache.
+func (e *ExclusionSettings) excludesCached(guild string, user string) bool {
+	roles, bot := guildMembers(guild).member(user)
+	return e.excludes(user, bot, roles)
+}
+
+func formatExclusionSettings(exclusions ExclusionSettings) string {
+	var excluded []string
+	for _, user := range exclusions.Users {
+		excluded = append(excluded, fmt.Sprintf("<@%s>", user))
+	}
+	for _, role := range exclusions.Roles {
+		excluded = append(excluded, fmt.Sprintf("<@&%s>", role))
+	}
+	if len(excluded) == 0 {
+		excluded = append(excluded, "none")
+	}
+	bots := "counted"
+	if exclusions.IgnoreBots {
+		bots = "ignored"
+	}
+	return fmt.Sprintf("**Excluded:** %s\n**Bots and Webhooks:** %s", strings.Join(excluded, ", "), bots)
+}
+
+// toggle adds the value to the list or removes it if it is already contained.
+func toggle(values []string, value string) []string {
+	if slices.Contains(values, value) {
+		return slices.DeleteFunc(values, func(v string) bool {
+			return v == value
+		})
+	}
+	return append(values, value)
+}
+
+func init() {
+	maps.Copy(messageComponents, map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+		"toggle_exclusion": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			data := i.MessageComponentData()
+			err := updateGuildSettings(i.GuildID, func(settings *GuildSettings) error {
+				for _, id := range data.Values {
+					if _, ok := data.Resolved.Roles[id]; ok {
+						settings.Exclusions.Roles = toggle(settings.Exclusions.Roles, id)
+					} else {
+						settings.Exclusions.Users = toggle(settings.Exclusions.Users, id)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return
+			}
+
+			updateSettingsMessage(s, i)
+		},
+		"toggle_ignore_bots": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			err := updateGuildSettings(i.GuildID, func(settings *GuildSettings) error {
+				settings.Exclusions.IgnoreBots = !settings.Exclusions.IgnoreBots
+				return nil
+			})
+			if err != nil {
+				return
+			}
+
+			updateSettingsMessage(s, i)
+		},
+	})
+}
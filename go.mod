@@ -7,7 +7,9 @@ require (
 	github.com/deckarep/golang-set/v2 v2.8.0
 	github.com/pelletier/go-toml v1.9.5
 	github.com/robfig/cron v1.2.0
+	go.etcd.io/bbolt v1.4.0
 	golang.org/x/crypto/x509roots/fallback v0.0.0-20250904143959-9d779377cff7
+	golang.org/x/image v0.25.0
 	gonum.org/v1/plot v0.16.0
 )
 
@@ -22,7 +24,6 @@ require (
 	github.com/gorilla/websocket v1.4.2 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b // indirect
-	golang.org/x/image v0.25.0 // indirect
 	golang.org/x/sys v0.30.0 // indirect
 	golang.org/x/text v0.23.0 // indirect
 )
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/font"
+	"gonum.org/v1/plot/vg"
+	"gonum.org/v1/plot/vg/draw"
+	"gonum.org/v1/plot/vg/vgimg"
+)
+
+const leaderboardPageSize = 10
+
+var avatarClient = &http.Client{Timeout: 3 * time.Second}
+
+type leaderboardEntry struct {
+	pair
+	name   string
+	avatar image.Image
+	role   *discordgo.Role
+}
+
+func fetchAvatar(url string) image.Image {
+	resp, err := avatarClient.Get(url)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	img, _, err := image.Decode(resp.Body)
+	if err != nil {
+		return nil
+	}
+	return img
+}
+
+// reachedRole returns the ranking role of the user or else the reward role with the highest target the user reached.
+func reachedRole(guild string, track *TrackSettings, targetRoles map[string]*RoleTargets, user string) *discordgo.Role {
+	for _, rank := range track.RankRoles {
+		if targets, ok := targetRoles[rank.Role]; ok && targets.Gain.Contains(user) {
+			return cachedRole(guild, rank.Role)
+		}
+	}
+
+	var best *discordgo.Role
+	var bestTarget int64 = 0
+	for role, reward := range track.RewardRoles {
+		if targets, ok := targetRoles[role]; ok && targets.Gain.Contains(user) && (best == nil || reward.Target > bestTarget) {
+			if r := cachedRole(guild, role); r != nil {
+				best = r
+				bestTarget = reward.Target
+			}
+		}
+	}
+	return best
+}
+
+func leaderboardEntries(s *discordgo.Session, guild string, track string, page int) ([]leaderboardEntry, int) {
+	// the exclusions are checked against the cached member roles
+	if err := guildMembers(guild).ensureLoaded(s); err != nil {
+		log.Printf("Failed to load the members of guild %s: %e", guild, err)
+	}
+
+	trackSettings := guildSettings(guild).track(track)
+	ranked, targetRoles := computeTrackRewards(guild, track)
+
+	pages := max((len(ranked)+leaderboardPageSize-1)/leaderboardPageSize, 1)
+	page = min(max(page, 0), pages-1)
+	ranked = ranked[min(page*leaderboardPageSize, len(ranked)):min((page+1)*leaderboardPageSize, len(ranked))]
+
+	entries := make([]leaderboardEntry, len(ranked))
+	var wg sync.WaitGroup
+	for i, entry := range ranked {
+		entries[i] = leaderboardEntry{
+			pair: entry,
+			name: entry.User,
+			role: reachedRole(guild, trackSettings, targetRoles, entry.User),
+		}
+
+		member, err := s.State.Member(guild, entry.User)
+		if err != nil {
+			member, err = s.GuildMember(guild, entry.User)
+		}
+		if err != nil || member.User == nil {
+			continue
+		}
+		entries[i].name = member.DisplayName()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entries[i].avatar = fetchAvatar(member.AvatarURL("64"))
+		}()
+	}
+	wg.Wait()
+
+	return entries, pages
+}
+
+func renderLeaderboard(entries []leaderboardEntry) (*bytes.Buffer, error) {
+	rowHeight := 1.2 * vg.Centimeter
+	width := 16 * vg.Centimeter
+	height := vg.Length(max(len(entries), 1))*rowHeight + 1*vg.Centimeter
+
+	img := vgimg.NewWith(vgimg.UseWH(width, height), vgimg.UseBackgroundColor(color.RGBA{R: 20, G: 20, B: 24, A: 255}))
+	c := draw.New(img)
+
+	textStyle := draw.TextStyle{
+		Color:   color.White,
+		Font:    font.From(font.Font{Typeface: "gg sans"}, 14),
+		Handler: plot.DefaultTextHandler,
+		YAlign:  draw.YCenter,
+	}
+
+	if len(entries) == 0 {
+		style := textStyle
+		style.XAlign = draw.XCenter
+		c.FillText(style, vg.Point{X: width / 2, Y: height / 2}, "Nobody is ranked yet.")
+	}
+
+	for i, entry := range entries {
+		y := height - 0.5*vg.Centimeter - vg.Length(i)*rowHeight - rowHeight/2
+
+		c.FillText(textStyle, vg.Point{X: 0.5 * vg.Centimeter, Y: y}, fmt.Sprintf("#%d", entry.Rank))
+
+		if entry.avatar != nil {
+			size := rowHeight - 0.3*vg.Centimeter
+			c.DrawImage(vg.Rectangle{
+				Min: vg.Point{X: 2 * vg.Centimeter, Y: y - size/2},
+				Max: vg.Point{X: 2*vg.Centimeter + size, Y: y + size/2},
+			}, entry.avatar)
+		}
+
+		c.FillText(textStyle, vg.Point{X: 3.4 * vg.Centimeter, Y: y}, entry.name)
+
+		if entry.role != nil {
+			style := textStyle
+			style.Color = color.RGBA{uint8(entry.role.Color >> 16), uint8(entry.role.Color >> 8), uint8(entry.role.Color), 0xFF}
+			c.FillText(style, vg.Point{X: 9.5 * vg.Centimeter, Y: y}, entry.role.Name)
+		}
+
+		style := textStyle
+		style.XAlign = draw.XRight
+		c.FillText(style, vg.Point{X: width - 0.5*vg.Centimeter, Y: y}, strconv.FormatFloat(entry.Val, 'f', -1, 64))
+	}
+
+	var buf bytes.Buffer
+	png := vgimg.PngCanvas{Canvas: img}
+	if _, err := png.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+// leaderboardMessage renders the page of the leaderboard as edit of a deferred interaction response.
+func leaderboardMessage(s *discordgo.Session, guild string, track string, page int) (*discordgo.WebhookEdit, error) {
+	entries, pages := leaderboardEntries(s, guild, track, page)
+	page = min(max(page, 0), pages-1)
+
+	buf, err := renderLeaderboard(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	content := fmt.Sprintf("**Leaderboard%s** (page %d/%d)", trackDescription(track), page+1, pages)
+	return &discordgo.WebhookEdit{
+		Content: &content,
+		Components: &[]discordgo.MessageComponent{
+			discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					discordgo.Button{
+						Label:    "Previous",
+						Style:    discordgo.SecondaryButton,
+						Disabled: page == 0,
+						CustomID: fmt.Sprintf("leaderboard|%d|%s", page-1, track),
+					},
+					discordgo.Button{
+						Label:    "Next",
+						Style:    discordgo.SecondaryButton,
+						Disabled: page >= pages-1,
+						CustomID: fmt.Sprintf("leaderboard|%d|%s", page+1, track),
+					},
+				},
+			},
+		},
+		Files: []*discordgo.File{
+			{
+				Name:        "leaderboard.png",
+				ContentType: "image/png",
+				Reader:      buf,
+			},
+		},
+		Attachments:     &[]*discordgo.MessageAttachment{},
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	}, nil
+}
+
+func respondLeaderboard(s *discordgo.Session, i *discordgo.InteractionCreate, track string, page int) {
+	if _, ok := guildSettings(i.GuildID).Tracks[track]; !ok {
+		content := fmt.Sprintf("There is no track named %s.", track)
+		if _, err := s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{Content: &content}); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	edit, err := leaderboardMessage(s, i.GuildID, track, page)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if _, err = s.InteractionResponseEdit(i.Interaction, edit); err != nil {
+		log.Println(err)
+	}
+}
+
+func init() {
+	maps.Copy(commands, map[*discordgo.ApplicationCommand]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+		{
+			Name:        "leaderboard",
+			Description: "Shows the members with the highest activity.",
+			Type:        discordgo.ChatApplicationCommand,
+			Options: []*discordgo.ApplicationCommandOption{
+				trackOption(),
+			},
+		}: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+			})
+			if err != nil {
+				log.Println(err)
+				return
+			}
+
+			respondLeaderboard(s, i, commandTrack(i), 0)
+		},
+	})
+
+	maps.Copy(messageComponents, map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+		"leaderboard": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			ids := strings.Split(i.MessageComponentData().CustomID, "|")
+			page, err := strconv.Atoi(ids[1])
+			if err != nil {
+				return
+			}
+			track := DefaultTrack
+			if len(ids) > 2 {
+				track = ids[2]
+			}
+
+			err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseDeferredMessageUpdate,
+			})
+			if err != nil {
+				log.Println(err)
+				return
+			}
+
+			respondLeaderboard(s, i, track, page)
+		},
+	})
+}
@@ -10,11 +10,11 @@ import (
 	"os/signal"
 	"slices"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
-	"github.com/robfig/cron"
 	goFont "golang.org/x/image/font"
 	"golang.org/x/image/font/sfnt"
 	"gonum.org/v1/plot"
@@ -25,74 +25,133 @@ import (
 	_ "golang.org/x/crypto/x509roots/fallback"
 )
 
-type Metric struct {
-	Time         time.Time
-	MessageCount int64
-}
-
-type Store struct {
-	Metrics []Metric
-}
-
 var token string
 var app string
-var guild string
+var legacyGuild string
+var controlGuild string
+var storeType string
+var storePath string
+var storeImport string
+var backupGenerations int
+var backupInterval time.Duration
+var dryRun bool
+var shutdownTimeout time.Duration
 
 var dg *discordgo.Session
-var cronJobs *cron.Cron
 
 var commandCache = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){}
-var roleCache = map[string]*discordgo.Role{}
+var roleCache = struct {
+	mutex  sync.RWMutex
+	Guilds map[string]map[string]*discordgo.Role
+}{
+	Guilds: map[string]map[string]*discordgo.Role{},
+}
 
 func i64(v int64) *int64 { return &v }
 
 func init() {
 	flag.StringVar(&token, "t", os.Getenv("DISCORD_TOKEN"), "Bot Token")
 	flag.StringVar(&app, "a", os.Getenv("DISCORD_APP"), "Application ID")
-	flag.StringVar(&guild, "g", os.Getenv("DISCORD_GUILD"), "Guild ID")
-	flag.Parse()
-
-	loadDiscordFontCache()
+	flag.StringVar(&legacyGuild, "g", os.Getenv("DISCORD_GUILD"), "Guild ID the data of a single guild installation belongs to")
+	flag.StringVar(&controlGuild, "control-guild", os.Getenv("ALICE_CONTROL_GUILD"), "Guild ID whose admins control the jobs of all guilds, defaults to -g")
+	flag.StringVar(&storeType, "s", os.Getenv("ALICE_STORE"), "Storage backend: file (default), bolt or memory")
+	flag.StringVar(&storePath, "p", os.Getenv("ALICE_STORE_PATH"), "Path of the storage backend, a directory for file and a database for bolt")
+	flag.StringVar(&storeImport, "import", "", "Copy all data of another storage backend given as type:path into the selected one")
+	flag.IntVar(&backupGenerations, "backups", 24, "Number of backup generations to keep of the stored data")
+	flag.DurationVar(&backupInterval, "backup-interval", time.Hour, "Minimum time between two backup generations")
+	flag.BoolVar(&dryRun, "dry-run", false, "Only log the reward role changes instead of applying them")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "Maximum time to wait for running jobs when shutting down")
 }
 
-func updateAllowedChannels(dg *discordgo.Session) {
-	Settings.metricChannelFilter.updateCache(dg)
-}
-
-func reloadCron() {
-	if cronJobs != nil {
-		cronJobs.Stop()
-	}
+// setup parses the flags, opens the store and loads the settings. It runs in main instead of init,
+// so the tests of the package do not open a store.
+func setup() {
+	flag.Parse()
 
-	cronJobs := cron.New()
-	err := cronJobs.AddFunc(Settings.Cron.CumulationStep, stepCumulation)
+	s, err := openStore(storeType, storePath)
 	if err != nil {
-		log.Println(err)
+		log.Panicln("error opening store,", err)
 	}
-	err = cronJobs.AddFunc(Settings.Cron.SaveMetrics, storeMetrics)
-	if err != nil {
-		log.Println(err)
+	store = &BackupStore{
+		Store:       s,
+		Generations: backupGenerations,
+		Interval:    backupInterval,
 	}
-	err = cronJobs.AddFunc(Settings.Cron.UpdateRewards, updateRewards)
-	if err != nil {
-		log.Println(err)
+	if storeImport != "" {
+		log.Printf("Importing data from %s...", storeImport)
+		if err = importStore(storeImport); err != nil {
+			log.Panicln("error importing store,", err)
+		}
 	}
-	cronJobs.Start()
+
+	loadSettings()
+	loadDiscordFontCache()
 }
 
-func updateRoleCache() {
-	roleCache = map[string]*discordgo.Role{}
+func updateAllowedChannels(dg *discordgo.Session, guild string) {
+	for _, track := range guildSettings(guild).Tracks {
+		track.metricChannelFilter.updateCache(dg, guild)
+	}
+}
+
+func updateRoleCache(guild string) {
 	roles, err := dg.GuildRoles(guild)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+
+	cache := map[string]*discordgo.Role{}
 	for _, role := range roles {
-		roleCache[role.ID] = role
+		cache[role.ID] = role
+	}
+
+	roleCache.mutex.Lock()
+	roleCache.Guilds[guild] = cache
+	roleCache.mutex.Unlock()
+}
+
+// rolesCached tells whether the roles of the guild are cached yet.
+func rolesCached(guild string) bool {
+	roleCache.mutex.RLock()
+	defer roleCache.mutex.RUnlock()
+
+	_, ok := roleCache.Guilds[guild]
+	return ok
+}
+
+func cachedRole(guild string, role string) *discordgo.Role {
+	roleCache.mutex.RLock()
+	defer roleCache.mutex.RUnlock()
+
+	return roleCache.Guilds[guild][role]
+}
+
+// controlCommands affect all guilds and are only registered in the control guild.
+var controlCommands = map[string]bool{}
+
+// isControlGuild tells whether the admins of the guild may control the jobs of all guilds.
+func isControlGuild(guild string) bool {
+	control := controlGuild
+	if control == "" {
+		control = legacyGuild
+	}
+	return control != "" && guild == control
+}
+
+func registerCommands(s *discordgo.Session, guild string) {
+	guildCommands := slices.DeleteFunc(slices.Collect(maps.Keys(commands)), func(cmd *discordgo.ApplicationCommand) bool {
+		return controlCommands[cmd.Name] && !isControlGuild(guild)
+	})
+	_, err := s.ApplicationCommandBulkOverwrite(app, guild, guildCommands)
+	if err != nil {
+		log.Printf("could not register commands for guild %s: %s", guild, err)
 	}
 }
 
 func main() {
+	setup()
+
 	for cmd, f := range commands {
 		commandCache[cmd.Name] = f
 	}
@@ -104,8 +163,19 @@ func main() {
 		log.Panicln("error creating Discord session,", err)
 	}
 
-	dg.AddHandler(metricMessage)
-	dg.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	var removeHandlers []func()
+	addHandler := func(handler interface{}) {
+		removeHandlers = append(removeHandlers, dg.AddHandler(handler))
+	}
+
+	addHandler(metricMessage)
+	addHandler(metricReaction)
+	addHandler(metricReactionRemove)
+	addHandler(voiceStateUpdate)
+	addHandler(memberAdd)
+	addHandler(memberUpdate)
+	addHandler(memberRemove)
+	addHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
 		switch i.Type {
 		case discordgo.InteractionApplicationCommand:
 			f, ok := commandCache[i.ApplicationCommandData().Name]
@@ -114,7 +184,8 @@ func main() {
 			}
 			break
 		case discordgo.InteractionMessageComponent:
-			f, ok := messageComponents[i.MessageComponentData().CustomID]
+			ids := strings.Split(i.MessageComponentData().CustomID, "|")
+			f, ok := messageComponents[ids[0]]
 			if ok {
 				f(s, i)
 			}
@@ -128,42 +199,105 @@ func main() {
 			break
 		}
 	})
-	dg.AddHandler(func(s *discordgo.Session, c *discordgo.ChannelCreate) {
-		updateAllowedChannels(s)
+	addHandler(func(s *discordgo.Session, g *discordgo.GuildCreate) {
+		log.Printf("Joined guild %s (%s).", g.Name, g.ID)
+		registerCommands(s, g.ID)
+		updateAllowedChannels(s, g.ID)
+		updateRoleCache(g.ID)
+		warnSettingsProblems(g.ID)
+		startVoiceSessions(s, g.Guild)
 	})
-	dg.AddHandler(func(s *discordgo.Session, c *discordgo.ChannelUpdate) {
-		updateAllowedChannels(s)
+	addHandler(func(s *discordgo.Session, c *discordgo.ChannelCreate) {
+		updateAllowedChannels(s, c.GuildID)
 	})
-	dg.AddHandler(func(s *discordgo.Session, c *discordgo.ChannelDelete) {
-		updateAllowedChannels(s)
+	addHandler(func(s *discordgo.Session, c *discordgo.ChannelUpdate) {
+		updateAllowedChannels(s, c.GuildID)
+	})
+	addHandler(func(s *discordgo.Session, c *discordgo.ChannelDelete) {
+		updateAllowedChannels(s, c.GuildID)
+	})
+	addHandler(func(s *discordgo.Session, r *discordgo.GuildRoleCreate) {
+		updateRoleCache(r.GuildID)
+	})
+	addHandler(func(s *discordgo.Session, r *discordgo.GuildRoleUpdate) {
+		updateRoleCache(r.GuildID)
+	})
+	addHandler(func(s *discordgo.Session, r *discordgo.GuildRoleDelete) {
+		updateRoleCache(r.GuildID)
 	})
 
-	dg.Identify.Intents = discordgo.IntentsGuildMessages | discordgo.IntentsGuildIntegrations | discordgo.IntentsGuildMembers
-
-	_, err = dg.ApplicationCommandBulkOverwrite(app, guild, slices.Collect(maps.Keys(commands)))
-	if err != nil {
-		log.Panicln("could not register commands: %s", err)
-	}
+	dg.Identify.Intents = discordgo.IntentsGuilds | discordgo.IntentsGuildMessages | discordgo.IntentsGuildIntegrations | discordgo.IntentsGuildMembers |
+		discordgo.IntentsGuildVoiceStates | discordgo.IntentsGuildMessageReactions
+	dg.State.MaxMessageCount = 100
 
 	err = dg.Open()
 	if err != nil {
 		log.Panicln("error opening connection,", err)
 	}
 
-	updateAllowedChannels(dg)
-	updateRoleCache()
-
-	reloadCron()
+	if err = scheduler.reschedule(cronSettings()); err != nil {
+		log.Panicln("error scheduling jobs,", err)
+	}
 
-	defer storeMetrics()
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	reloadsDone := make(chan struct{})
+	go func() {
+		defer close(reloadsDone)
+		for range reloads {
+			reloadSettings(dg)
+		}
+	}()
 
-	log.Println("Bot is now running. Press CTRL-C to exit.")
+	log.Println("Bot is now running. Press CTRL-C to exit, send SIGHUP to reload the settings.")
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 	<-sc
+
+	// let a running reload finish, it writes the settings and reschedules the jobs
+	signal.Stop(reloads)
+	close(reloads)
+	<-reloadsDone
+	shutdown(removeHandlers)
+}
+
+// shutdown stops the bot in an order that keeps the data of running work:
+// no new events are handled, running jobs finish, the data is saved and only then the gateway is closed.
+func shutdown(removeHandlers []func()) {
 	log.Println("Shutting down...")
 
-	dg.Close()
+	log.Println("Stopping event handling...")
+	for _, remove := range removeHandlers {
+		remove()
+	}
+
+	log.Println("Stopping scheduler...")
+	scheduler.stop()
+	if scheduler.wait(shutdownTimeout) {
+		log.Println("Running jobs finished.")
+	} else {
+		log.Printf("Running jobs did not finish within %s, saving anyway.", shutdownTimeout)
+	}
+
+	log.Println("Saving data...")
+	flushVoice()
+	storeMetrics()
+	Settings.mutex.Lock()
+	if err := writeSettings(); err != nil {
+		log.Printf("Failed to save settings: %e", err)
+	}
+	Settings.mutex.Unlock()
+
+	log.Println("Closing gateway...")
+	if err := dg.Close(); err != nil {
+		log.Println(err)
+	}
+
+	log.Println("Closing store...")
+	if err := store.Close(); err != nil {
+		log.Println(err)
+	}
+
 	log.Println("Bot stopped!")
 }
 
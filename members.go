@@ -0,0 +1,206 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	mapset "github.com/deckarep/golang-set/v2"
+)
+
+// MemberCache maps the members of a guild to their roles and remembers which members are bots.
+// It is kept up to date by member events and reconciled with a full member list periodically.
+type MemberCache struct {
+	mutex   sync.Mutex
+	guild   string
+	loaded  bool
+	members map[string]mapset.Set[string]
+	bots    mapset.Set[string]
+}
+
+var memberCaches = struct {
+	mutex  sync.Mutex
+	Guilds map[string]*MemberCache
+}{
+	Guilds: map[string]*MemberCache{},
+}
+
+func guildMembers(guild string) *MemberCache {
+	memberCaches.mutex.Lock()
+	defer memberCaches.mutex.Unlock()
+
+	cache, ok := memberCaches.Guilds[guild]
+	if !ok {
+		cache = &MemberCache{
+			guild:   guild,
+			members: map[string]mapset.Set[string]{},
+			bots:    mapset.NewThreadUnsafeSet[string](),
+		}
+		memberCaches.Guilds[guild] = cache
+	}
+	return cache
+}
+
+// reconcile replaces the cache with the full member list of the guild.
+func (c *MemberCache) reconcile(s *discordgo.Session) error {
+	members := map[string]mapset.Set[string]{}
+	bots := mapset.NewThreadUnsafeSet[string]()
+
+	after := ""
+	for {
+		batch, err := s.GuildMembers(c.guild, after, 1000)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		after = batch[len(batch)-1].User.ID
+
+		for _, member := range batch {
+			members[member.User.ID] = mapset.NewThreadUnsafeSet(member.Roles...)
+			if member.User.Bot {
+				bots.Add(member.User.ID)
+			}
+		}
+
+		if len(batch) < 1000 {
+			break
+		}
+	}
+
+	c.mutex.Lock()
+	c.members = members
+	c.bots = bots
+	c.loaded = true
+	c.mutex.Unlock()
+
+	log.Printf("Reconciled %d members of guild %s.", len(members), c.guild)
+	return nil
+}
+
+// ensureLoaded reconciles the cache if it was never loaded.
+func (c *MemberCache) ensureLoaded(s *discordgo.Session) error {
+	c.mutex.Lock()
+	loaded := c.loaded
+	c.mutex.Unlock()
+
+	if loaded {
+		return nil
+	}
+	return c.reconcile(s)
+}
+
+func (c *MemberCache) set(member *discordgo.Member) {
+	if member == nil || member.User == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.members[member.User.ID] = mapset.NewThreadUnsafeSet(member.Roles...)
+	if member.User.Bot {
+		c.bots.Add(member.User.ID)
+	}
+}
+
+func (c *MemberCache) remove(user string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.members, user)
+	c.bots.Remove(user)
+}
+
+// member returns the roles of the user and whether the user is a bot, roles is nil if the user is unknown.
+func (c *MemberCache) member(user string) ([]string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	roles, ok := c.members[user]
+	if !ok {
+		return nil, c.bots.Contains(user)
+	}
+	return roles.ToSlice(), c.bots.Contains(user)
+}
+
+// hasRole reports whether the user has the role and whether the user is a member at all.
+func (c *MemberCache) hasRole(user string, role string) (bool, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	roles, ok := c.members[user]
+	if !ok {
+		return false, false
+	}
+	return roles.Contains(role), true
+}
+
+// roleMembers returns all members with the role.
+func (c *MemberCache) roleMembers(role string) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var users []string
+	for user, roles := range c.members {
+		if roles.Contains(role) {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+func (c *MemberCache) addRole(user string, role string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if roles, ok := c.members[user]; ok {
+		roles.Add(role)
+	}
+}
+
+func (c *MemberCache) removeRole(user string, role string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if roles, ok := c.members[user]; ok {
+		roles.Remove(role)
+	}
+}
+
+func reconcileMembers() {
+	for _, guild := range joinedGuilds() {
+		if err := guildMembers(guild).reconcile(dg); err != nil {
+			log.Printf("Failed to reconcile members of guild %s: %e", guild, err)
+		}
+	}
+}
+
+// joinedGuilds returns the IDs of all guilds the bot is a member of.
+func joinedGuilds() []string {
+	dg.State.RLock()
+	defer dg.State.RUnlock()
+
+	guilds := make([]string, 0, len(dg.State.Guilds))
+	for _, guild := range dg.State.Guilds {
+		guilds = append(guilds, guild.ID)
+	}
+	slices.Sort(guilds)
+	return guilds
+}
+
+func memberAdd(s *discordgo.Session, m *discordgo.GuildMemberAdd) {
+	guildMembers(m.GuildID).set(m.Member)
+}
+
+func memberUpdate(s *discordgo.Session, m *discordgo.GuildMemberUpdate) {
+	guildMembers(m.GuildID).set(m.Member)
+}
+
+func memberRemove(s *discordgo.Session, m *discordgo.GuildMemberRemove) {
+	if m.User != nil {
+		guildMembers(m.GuildID).remove(m.User.ID)
+	}
+}
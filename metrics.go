@@ -4,12 +4,12 @@ import (
 	"bytes"
 	"cmp"
 	"encoding/gob"
+	"fmt"
 	"image/color"
 	"log"
 	"maps"
-	"os"
+	"math"
 	"slices"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -25,12 +25,96 @@ import (
 	"github.com/bwmarrin/discordgo"
 )
 
-var Metrics = struct {
+const dateFormat = "2006-01-02"
+
+// DailyPoints maps users to the points they earned per calendar date in the timezone of the guild.
+type DailyPoints map[string]map[string]int64
+
+// MetricStore contains the metrics of a track of a guild.
+type MetricStore struct {
 	mutex     sync.Mutex
+	guild     string
+	track     string
 	LastStore time.Time
-	Data      map[string]*[]int64
+	// Series maps the metric sources like messages or voice minutes to the points earned from them.
+	Series map[string]DailyPoints
+
+	// Suppressed contains the number of messages per calendar date which were suppressed as spam.
+	Suppressed DailyPoints
+	// Reactions maps the reactions which earned points to where they were counted, see reactionKey.
+	// They are stored, so a reaction neither earns points twice nor keeps them when removed after a restart.
+	Reactions map[string]CountedReaction
+
+	// Days contains the message points of previous versions and is only read for migration.
+	Days DailyPoints
+	// Data contains the per cumulation step buckets of previous versions and is only read for migration.
+	Data map[string]*[]int64
+
+	spam map[string]*spamState
+}
+
+var Metrics = struct {
+	mutex sync.Mutex
+	// Guilds maps guilds to tracks to their metric stores.
+	Guilds map[string]map[string]*MetricStore
 }{
-	Data: make(map[string]*[]int64),
+	Guilds: make(map[string]map[string]*MetricStore),
+}
+
+// trackMetrics returns the metric store of the track of the given guild and loads it on first access.
+func trackMetrics(guild string, track string) *MetricStore {
+	Metrics.mutex.Lock()
+	defer Metrics.mutex.Unlock()
+
+	tracks, ok := Metrics.Guilds[guild]
+	if !ok {
+		tracks = make(map[string]*MetricStore)
+		Metrics.Guilds[guild] = tracks
+	}
+	metrics, ok := tracks[track]
+	if !ok {
+		metrics = &MetricStore{
+			guild:  guild,
+			track:  track,
+			Series: make(map[string]DailyPoints),
+		}
+		metrics.load()
+		tracks[track] = metrics
+	}
+	return metrics
+}
+
+func loadedMetrics() []*MetricStore {
+	Metrics.mutex.Lock()
+	defer Metrics.mutex.Unlock()
+
+	var loaded []*MetricStore
+	for _, tracks := range Metrics.Guilds {
+		loaded = slices.AppendSeq(loaded, maps.Values(tracks))
+	}
+	return loaded
+}
+
+// removeTrackMetrics drops the metrics of a removed track.
+func removeTrackMetrics(guild string, track string) {
+	Metrics.mutex.Lock()
+	defer Metrics.mutex.Unlock()
+
+	delete(Metrics.Guilds[guild], track)
+	if err := store.Delete(metricsKey(guild, track)); err != nil && err != ErrNotStored {
+		log.Printf("Failed to delete metrics of track %s of guild %s: %e", track, guild, err)
+	}
+}
+
+// matchingTracks returns the names of the tracks of the guild whose channel filter matches the channel.
+func matchingTracks(settings *GuildSettings, channel *discordgo.Channel) []string {
+	var tracks []string
+	for name, track := range settings.Tracks {
+		if track.metricChannelFilter.matchCachedChannel(channel) {
+			tracks = append(tracks, name)
+		}
+	}
+	return tracks
 }
 
 type IntValues []int64
@@ -66,7 +150,7 @@ func barChart(entries *[]int64, title string) (*plot.Plot, error) {
 	p.Y.Min = 0
 	p.Y.Scale = SymlogScale{Base: 2, LinScale: 1, LinThresh: 20}
 	p.Y.Tick.Marker = SymlogTicks{Base: 2, LinThresh: 20}
-	p.Y.Label.Text = "Msgs./Day"
+	p.Y.Label.Text = "Points/Day"
 	p.Y.Label.TextStyle.Color = color.White
 	p.Y.Tick.Color = color.White
 	p.Y.Tick.Label.Color = color.White
@@ -90,12 +174,33 @@ func init() {
 			Name: "Alice Stats",
 			Type: discordgo.UserApplicationCommand,
 		}: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
-			entriesPtr := Metrics.Data[i.Interaction.ApplicationCommandData().TargetID]
-			if entriesPtr == nil {
-				entries := slices.Repeat([]int64{0}, Settings.NumTrackedDays)
-				entriesPtr = &entries
+			settings := guildSettings(i.GuildID)
+			metrics := trackMetrics(i.GuildID, DefaultTrack)
+
+			metrics.mutex.Lock()
+			entries := metrics.window(i.Interaction.ApplicationCommandData().TargetID, time.Now())
+			suppressed := metrics.suppressed(i.Interaction.ApplicationCommandData().TargetID, time.Now())
+			var totals []string
+			for _, series := range allSeries {
+				var total int64 = 0
+				for _, v := range metrics.seriesWindow(series, i.Interaction.ApplicationCommandData().TargetID, time.Now()) {
+					total += v
+				}
+				totals = append(totals, fmt.Sprintf("%s: %d", seriesNames[series], total))
+			}
+			metrics.mutex.Unlock()
+
+			// the charts show the default track, other tracks are summarized
+			for _, name := range settings.trackNames()[1:] {
+				trackStore := trackMetrics(i.GuildID, name)
+				trackStore.mutex.Lock()
+				var total int64 = 0
+				for _, v := range trackStore.window(i.Interaction.ApplicationCommandData().TargetID, time.Now()) {
+					total += v
+				}
+				trackStore.mutex.Unlock()
+				totals = append(totals, fmt.Sprintf("Track %s: %d", name, total))
 			}
-			entries := slices.Clone(*entriesPtr)
 
 			historyPlot, err := barChart(&entries, "Chat Stats History")
 
@@ -117,8 +222,9 @@ func init() {
 			roleTextStyle.Handler = plot.DefaultTextHandler
 			minRight := vg.Length(0)
 			rewards := []RewardPair{}
-			for roleId, target := range Settings.RewardRole {
-				role := roleCache[roleId]
+			for roleId, reward := range settings.track(DefaultTrack).RewardRoles {
+				target := reward.Target
+				role := cachedRole(i.GuildID, roleId)
 				if role == nil {
 					continue
 				}
@@ -146,13 +252,13 @@ func init() {
 			for _, reward := range rewards {
 				roleId, target := reward.RoleID, reward.Target
 
-				role := roleCache[roleId]
+				role := cachedRole(i.GuildID, roleId)
 				if role == nil {
 					continue
 				}
 
-				xs := tx(float64(Settings.NumTrackedDays-1)/2) - vg.Centimeter/2
-				xe := tx(float64(Settings.NumTrackedDays))
+				xs := tx(float64(settings.NumTrackedDays-1)/2) - vg.Centimeter/2
+				xe := tx(float64(settings.NumTrackedDays))
 				ys := ty(0)
 				ye := ty(float64(target))
 
@@ -160,11 +266,11 @@ func init() {
 				style.Width = 1 * vg.Millimeter
 				style.Color = color.RGBA{uint8(role.Color >> 16), uint8(role.Color >> 8), uint8(role.Color), 0xFF}
 
-				dataCanvas.StrokeLines(style, []vg.Point{{xs, ys}, {xs, ye}, {xe, ye}})
+				dataCanvas.StrokeLines(style, []vg.Point{{X: xs, Y: ys}, {X: xs, Y: ye}, {X: xe, Y: ye}})
 
 				textStyle := roleTextStyle
 				textStyle.Color = style.Color
-				dataCanvas.FillText(textStyle, vg.Point{xe, ye}, role.Name)
+				dataCanvas.FillText(textStyle, vg.Point{X: xe, Y: ye}, role.Name)
 			}
 
 			var sortedBuf bytes.Buffer
@@ -201,6 +307,9 @@ func init() {
 								},
 							},
 						},
+						discordgo.TextDisplay{
+							Content: fmt.Sprintf("-# %s\n-# %d messages suppressed as spam in the last %d days", strings.Join(totals, ", "), suppressed, settings.NumTrackedDays),
+						},
 					},
 					Flags: flags,
 					Files: []*discordgo.File{
@@ -222,124 +331,260 @@ func init() {
 			}
 		},
 	})
+}
+
+// seriesWindow returns the points of the user in a series for each of the tracked days up to now, starting with today.
+// The caller has to hold the mutex.
+func (m *MetricStore) seriesWindow(series string, user string, now time.Time) []int64 {
+	settings := guildSettings(m.guild)
+	now = now.In(settings.location())
+
+	entries := make([]int64, settings.NumTrackedDays)
+	days := m.Series[series][user]
+	for i := range entries {
+		entries[i] = days[now.AddDate(0, 0, -i).Format(dateFormat)]
+	}
+	return entries
+}
+
+// window returns the score of the user for each of the tracked days up to now, starting with today.
+// The score combines all series weighted by the track settings.
+// The caller has to hold the mutex.
+func (m *MetricStore) window(user string, now time.Time) []int64 {
+	settings := guildSettings(m.guild)
+
+	scores := make([]float64, settings.NumTrackedDays)
+	for series, weight := range settings.track(m.track).SeriesWeights {
+		for i, v := range m.seriesWindow(series, user, now) {
+			scores[i] += float64(v) * weight
+		}
+	}
+
+	entries := make([]int64, settings.NumTrackedDays)
+	for i, score := range scores {
+		entries[i] = int64(math.Round(score))
+	}
+	return entries
+}
 
-	loadMetrics()
+// users returns all users with points in any series, the caller has to hold the mutex.
+func (m *MetricStore) users() []string {
+	users := map[string]bool{}
+	for _, points := range m.Series {
+		for user := range points {
+			users[user] = true
+		}
+	}
+	return slices.Collect(maps.Keys(users))
 }
 
-func addPoints(user string, points int64) {
-	Metrics.mutex.Lock()
-	defer Metrics.mutex.Unlock()
+func (m *MetricStore) addPoints(series string, user string, points int64, t time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.add(series, user, points, t)
+}
 
-	entry, ok := Metrics.Data[user]
+// add adds the points to the day of t, the caller has to hold the mutex.
+func (m *MetricStore) add(series string, user string, points int64, t time.Time) {
+	seriesPoints, ok := m.Series[series]
 	if !ok {
-		entries := make([]int64, Settings.NumTrackedDays)
-		entry = &entries
-		Metrics.Data[user] = entry
+		seriesPoints = DailyPoints{}
+		m.Series[series] = seriesPoints
+	}
+	seriesPoints.add(user, t.In(guildSettings(m.guild).location()).Format(dateFormat), points)
+}
+
+func (p DailyPoints) add(user string, date string, points int64) {
+	days, ok := p[user]
+	if !ok {
+		days = map[string]int64{}
+		p[user] = days
+	}
+	days[date] += points
+}
+
+// prune removes all days before oldest and users without any days left.
+func (p DailyPoints) prune(oldest string) {
+	for user, days := range p {
+		for date := range days {
+			if date < oldest {
+				delete(days, date)
+			}
+		}
+		if len(days) == 0 {
+			delete(p, user)
+		}
 	}
-	(*entry)[0] += points
 }
 
 func metricMessage(s *discordgo.Session, m *discordgo.MessageCreate) {
-	if !Settings.metricChannelFilter.matchCachedID(m.ChannelID) {
+	if m.GuildID == "" {
 		return
 	}
 	if s.State.User.ID == m.Author.ID {
 		return
 	}
+	settings := guildSettings(m.GuildID)
+	if m.WebhookID != "" && settings.Exclusions.IgnoreBots {
+		return
+	}
+	if settings.Exclusions.excludesMember(m.GuildID, m.Author, m.Member) {
+		return
+	}
+	channel := messageChannel(s, m.ChannelID)
+	if channel == nil {
+		return
+	}
 
-	addPoints(m.Author.ID, 1)
+	points := settings.Scoring.score(m.Message, channel)
+	for _, track := range matchingTracks(settings, channel) {
+		metrics := trackMetrics(m.GuildID, track)
+		if channel.IsThread() {
+			metricThreadMessage(metrics, m)
+		}
+		if points != 0 {
+			metrics.addMessagePoints(m.Author.ID, m.Content, points, m.Timestamp)
+		}
+	}
 }
 
-func stepCumulation() {
-	Metrics.mutex.Lock()
-	defer Metrics.mutex.Unlock()
+func pruneMetrics() {
+	flushVoice()
+	for _, metrics := range loadedMetrics() {
+		metrics.prune(time.Now())
+	}
+}
 
-	var toRemove []string
-	for user, entry := range Metrics.Data {
-		*entry = slices.Insert(*entry, 0, 0)
-		*entry = slices.Delete(*entry, Settings.NumTrackedDays, len(*entry))
+// prune removes all days which are no longer part of the tracked window and users without any points left.
+func (m *MetricStore) prune(now time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
-		var sum int64 = 0
-		for _, v := range *entry {
-			sum += v
-		}
-		if sum == 0 {
-			toRemove = append(toRemove, user)
-		}
+	settings := guildSettings(m.guild)
+	oldest := now.In(settings.location()).AddDate(0, 0, 1-settings.NumTrackedDays).Format(dateFormat)
+
+	for _, points := range m.Series {
+		points.prune(oldest)
 	}
+	m.pruneSpam(settings.Spam, oldest, now)
+	maps.DeleteFunc(m.Reactions, func(_ string, reaction CountedReaction) bool {
+		return reaction.Date < oldest
+	})
+}
 
-	for _, user := range toRemove {
-		delete(Metrics.Data, user)
+// metricsKey returns the store key of the metrics of a track, the default track keeps the key of previous versions.
+func metricsKey(guild string, track string) string {
+	if track == DefaultTrack {
+		return fmt.Sprintf("metrics_%s.gob", guild)
 	}
+	return fmt.Sprintf("metrics_%s_%s.gob", guild, track)
 }
 
-func loadMetrics() {
-	Metrics.mutex.Lock()
-	defer Metrics.mutex.Unlock()
+func (m *MetricStore) load() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
-	b, err := os.ReadFile("metrics.gob")
-	if err == nil {
-		b := bytes.NewBuffer(b)
-		dec := gob.NewDecoder(b)
-		if err = dec.Decode(&Metrics); err != nil {
-			log.Panicf("Failed to load metrics: %e", err)
+	if err := m.read(); err != nil {
+		log.Panicf("Failed to load metrics of track %s of guild %s: %e", m.track, m.guild, err)
+	}
+}
+
+// read decodes the stored metrics into the store, the caller has to hold the mutex.
+func (m *MetricStore) read() error {
+	b, err := store.Load(metricsKey(m.guild, m.track))
+	if err == ErrNotStored && m.guild == legacyGuild && m.track == DefaultTrack {
+		// metrics of single guild installations are stored without guild id
+		b, err = store.Load("metrics.gob")
+		if err == nil {
+			log.Printf("Migrating single guild metrics to guild %s.", m.guild)
 		}
+	}
+	if err == ErrNotStored {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// gob keeps the fields missing in the data and merges maps, so reset everything that is stored
+	m.LastStore = time.Time{}
+	m.Series = make(map[string]DailyPoints)
+	m.Suppressed = nil
+	m.Days = nil
+	m.Data = nil
+	m.Reactions = nil
+	dec := gob.NewDecoder(bytes.NewBuffer(b))
+	if err = dec.Decode(m); err != nil {
+		return err
+	}
+	if m.Series == nil {
+		m.Series = make(map[string]DailyPoints)
+	}
+
+	if len(m.Days) > 0 {
+		log.Printf("Migrating message points of guild %s to the %s series.", m.guild, SeriesMessages)
+		m.Series[SeriesMessages] = m.Days
+		m.Days = nil
+	}
 
-		for _, entries := range Metrics.Data {
-			insertionPoint := 0          // change insertion point based on metrics last stored
-			var insertionValue int64 = 0 // change insertion value based on already existing metrics
-			for len(*entries) < Settings.NumTrackedDays {
-				*entries = slices.Insert(*entries, insertionPoint, insertionValue)
+	if len(m.Data) > 0 {
+		// previous versions stored one bucket per cumulation step with the newest first,
+		// assign them to the days before the last store as best guess.
+		log.Printf("Migrating cumulation step buckets of guild %s to calendar days.", m.guild)
+		lastStore := m.LastStore.In(guildSettings(m.guild).location())
+		messages := DailyPoints{}
+		for user, entries := range m.Data {
+			for i, v := range *entries {
+				if v != 0 {
+					messages.add(user, lastStore.AddDate(0, 0, -i).Format(dateFormat), v)
+				}
 			}
-			*entries = slices.Delete(*entries, Settings.NumTrackedDays, len(*entries))
 		}
+		m.Series[SeriesMessages] = messages
+		m.Data = nil
 	}
+	return nil
 }
 
 func storeMetrics() {
-	Metrics.mutex.Lock()
-	defer Metrics.mutex.Unlock()
+	for _, metrics := range loadedMetrics() {
+		metrics.store()
+	}
+}
+
+func (m *MetricStore) store() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
-	Metrics.LastStore = time.Now()
+	m.LastStore = time.Now()
 
 	var b bytes.Buffer
 	enc := gob.NewEncoder(&b)
-	if err := enc.Encode(Metrics); err != nil {
-		log.Println("Failed to save metrics! %e", err)
+	if err := enc.Encode(m); err != nil {
+		log.Printf("Failed to save metrics! %e", err)
+		return
 	}
 
-	err := os.WriteFile("metrics.gob", b.Bytes(), 0644)
+	err := store.Save(metricsKey(m.guild, m.track), b.Bytes())
 	if err != nil {
-		log.Panicln("Failed to save metrics! %e", err)
+		log.Printf("Failed to save metrics! %e", err)
+		return
 	}
-	log.Println("Metrics saved.")
+	log.Printf("Metrics of track %s of guild %s saved.", m.track, m.guild)
 }
 
-func analyzeMetrics() map[string]int64 {
-	Metrics.mutex.Lock()
-	defer Metrics.mutex.Unlock()
+// windows returns the daily scores of the tracked days of all users.
+func (m *MetricStore) windows() map[string][]int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
-	var medians = map[string]int64{}
+	var windows = map[string][]int64{}
 
-	for user, entries := range Metrics.Data {
-		entries := slices.Clone(*entries)
-
-		s := strings.Builder{}
-		for _, v := range entries {
-			s.WriteString(strconv.FormatInt(v, 10))
-			s.WriteString(" ")
-		}
-		//log.Println(user, s.String())
-
-		slices.Sort(entries)
-		var median int64
-		if len(entries)%2 == 0 {
-			median = (entries[len(entries)/2-1] + entries[len(entries)/2]) / 2
-		} else {
-			median = entries[len(entries)/2]
-		}
-		medians[user] = median
+	now := time.Now()
+	for _, user := range m.users() {
+		windows[user] = m.window(user, now)
 	}
 
-	return medians
+	return windows
 }
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const previewPageLength = 1800
+
+// previewPages formats the role changes grouped by role into pages fitting into a message.
+func previewPages(changes []RoleChange) []string {
+	type roleDiff struct {
+		gains  []string
+		losses []string
+	}
+	var roles []string
+	diffs := map[string]*roleDiff{}
+	for _, change := range changes {
+		diff, ok := diffs[change.Role]
+		if !ok {
+			diff = &roleDiff{}
+			diffs[change.Role] = diff
+			roles = append(roles, change.Role)
+		}
+		if change.Add {
+			diff.gains = append(diff.gains, fmt.Sprintf("<@%s>", change.User))
+		} else {
+			diff.losses = append(diff.losses, fmt.Sprintf("<@%s>", change.User))
+		}
+	}
+
+	var lines []string
+	for _, role := range roles {
+		diff := diffs[role]
+		lines = append(lines, fmt.Sprintf("### <@&%s>", role))
+		if len(diff.gains) > 0 {
+			lines = append(lines, fmt.Sprintf("**Gains (%d):** %s", len(diff.gains), strings.Join(diff.gains, " ")))
+		}
+		if len(diff.losses) > 0 {
+			lines = append(lines, fmt.Sprintf("**Loses (%d):** %s", len(diff.losses), strings.Join(diff.losses, " ")))
+		}
+	}
+
+	var pages []string
+	var page strings.Builder
+	for _, line := range lines {
+		for len(line) > 0 {
+			if page.Len() > 0 && page.Len()+len(line)+1 > previewPageLength {
+				pages = append(pages, page.String())
+				page.Reset()
+			}
+			part := line
+			if len(part) > previewPageLength {
+				cut := strings.LastIndex(part[:previewPageLength], " ")
+				if cut <= 0 {
+					cut = previewPageLength
+				}
+				part = part[:cut]
+			}
+			page.WriteString(part)
+			page.WriteString("\n")
+			line = strings.TrimPrefix(line[len(part):], " ")
+		}
+	}
+	if page.Len() > 0 {
+		pages = append(pages, page.String())
+	}
+	if len(pages) == 0 {
+		pages = append(pages, "No reward roles would change.")
+	}
+	return pages
+}
+
+// previewResults keeps the pages of the previews shown by /alice_preview, so paging does not compute the role changes again.
+var previewResults = struct {
+	mutex sync.Mutex
+	// Pages maps the ID of the preview command interaction to the pages of its preview.
+	Pages map[string]previewResult
+}{
+	Pages: map[string]previewResult{},
+}
+
+type previewResult struct {
+	pages   []string
+	created time.Time
+}
+
+// rememberPreview keeps the pages of a preview as long as its message can be edited and forgets expired ones.
+func rememberPreview(id string, pages []string) {
+	previewResults.mutex.Lock()
+	defer previewResults.mutex.Unlock()
+
+	maps.DeleteFunc(previewResults.Pages, func(_ string, result previewResult) bool {
+		return time.Since(result.created) > interactionTokenLifetime
+	})
+	previewResults.Pages[id] = previewResult{pages: pages, created: time.Now()}
+}
+
+func rememberedPreview(id string) ([]string, bool) {
+	previewResults.mutex.Lock()
+	defer previewResults.mutex.Unlock()
+
+	result, ok := previewResults.Pages[id]
+	return result.pages, ok
+}
+
+func previewPage(id string, pages []string, page int) (string, []discordgo.MessageComponent) {
+	page = min(max(page, 0), len(pages)-1)
+
+	content := fmt.Sprintf("## Reward Preview (page %d/%d)\n%s", page+1, len(pages), pages[page])
+	components := []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Previous",
+					Style:    discordgo.SecondaryButton,
+					Disabled: page == 0,
+					CustomID: fmt.Sprintf("preview_rewards|%s|%d", id, page-1),
+				},
+				discordgo.Button{
+					Label:    "Next",
+					Style:    discordgo.SecondaryButton,
+					Disabled: page >= len(pages)-1,
+					CustomID: fmt.Sprintf("preview_rewards|%s|%d", id, page+1),
+				},
+			},
+		},
+	}
+	return content, components
+}
+
+func init() {
+	maps.Copy(commands, map[*discordgo.ApplicationCommand]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+		{
+			Name:                     "alice_preview",
+			Description:              "Shows who would gain or lose which reward role without changing any roles.",
+			Type:                     discordgo.ChatApplicationCommand,
+			DefaultMemberPermissions: i64(0),
+		}: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			// planning the rewards may load all members of the guild, which takes longer than Discord waits for a response
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Flags: discordgo.MessageFlagsEphemeral,
+				},
+			})
+			if err != nil {
+				log.Println(err)
+				return
+			}
+
+			go func() {
+				var content string
+				var components []discordgo.MessageComponent
+				changes, err := previewRewards(i.GuildID)
+				if err != nil {
+					log.Printf("Failed to preview rewards of guild %s: %e", i.GuildID, err)
+					content = fmt.Sprintf("Failed to preview rewards: %s", err)
+				} else {
+					pages := previewPages(changes)
+					rememberPreview(i.ID, pages)
+					content, components = previewPage(i.ID, pages, 0)
+				}
+
+				_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+					Content:         &content,
+					Components:      &components,
+					AllowedMentions: &discordgo.MessageAllowedMentions{},
+				})
+				if err != nil {
+					log.Println(err)
+				}
+			}()
+		},
+	})
+
+	maps.Copy(messageComponents, map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+		"preview_rewards": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			ids := strings.Split(i.MessageComponentData().CustomID, "|")
+			if len(ids) != 3 {
+				return
+			}
+			page, err := strconv.Atoi(ids[2])
+			if err != nil {
+				return
+			}
+
+			data := &discordgo.InteractionResponseData{
+				Content:         "This preview has expired, run /alice_preview again.",
+				Components:      []discordgo.MessageComponent{},
+				AllowedMentions: &discordgo.MessageAllowedMentions{},
+			}
+			if pages, ok := rememberedPreview(ids[1]); ok {
+				data.Content, data.Components = previewPage(ids[1], pages, page)
+			}
+
+			err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseUpdateMessage,
+				Data: data,
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		},
+	})
+}
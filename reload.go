@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// interactionTokenLifetime is how long Discord accepts edits of an interaction response.
+const interactionTokenLifetime = 15 * time.Minute
+
+// settingsPanel is a settings panel shown to an admin, track is empty for the main panel.
+type settingsPanel struct {
+	interaction *discordgo.Interaction
+	track       string
+	shown       time.Time
+}
+
+// settingsPanels remembers the last settings panel of every admin, so the panels can be refreshed after a reload.
+var settingsPanels = struct {
+	mutex  sync.Mutex
+	Panels map[string]settingsPanel
+}{
+	Panels: map[string]settingsPanel{},
+}
+
+func rememberSettingsPanel(i *discordgo.InteractionCreate, track string) {
+	if i.Member == nil || i.Member.User == nil {
+		return
+	}
+
+	settingsPanels.mutex.Lock()
+	defer settingsPanels.mutex.Unlock()
+
+	settingsPanels.Panels[i.GuildID+"|"+i.Member.User.ID] = settingsPanel{
+		interaction: i.Interaction,
+		track:       track,
+		shown:       time.Now(),
+	}
+}
+
+// refreshSettingsPanels shows the current settings in all panels that can still be edited.
+func refreshSettingsPanels(s *discordgo.Session) {
+	settingsPanels.mutex.Lock()
+	maps.DeleteFunc(settingsPanels.Panels, func(_ string, panel settingsPanel) bool {
+		return time.Since(panel.shown) > interactionTokenLifetime
+	})
+	panels := maps.Clone(settingsPanels.Panels)
+	settingsPanels.mutex.Unlock()
+
+	for _, panel := range panels {
+		guild := panel.interaction.GuildID
+		var components []discordgo.MessageComponent
+		if _, ok := guildSettings(guild).Tracks[panel.track]; ok {
+			components = createTrackSettings(s, guild, panel.track)
+		} else {
+			components = createSettings(s, guild)
+		}
+
+		_, err := s.InteractionResponseEdit(panel.interaction, &discordgo.WebhookEdit{
+			Components:      &components,
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		})
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// reloadSettings replaces the settings by the stored ones, e.g. after settings.toml was edited by hand.
+// The current settings stay in place if the stored settings cannot be parsed, are invalid or cannot be saved after a migration.
+func reloadSettings(s *discordgo.Session) error {
+	log.Println("Reloading settings...")
+
+	// hold the lock from loading to replacing, so no update made in between is lost
+	Settings.mutex.Lock()
+	b, err := store.Load(settingsKey)
+	if err != nil {
+		Settings.mutex.Unlock()
+		log.Printf("Failed to reload settings: %e", err)
+		return err
+	}
+	data, migrated, err := parseSettings(b)
+	if err == nil {
+		err = validateSettings(data)
+	}
+	if err != nil {
+		Settings.mutex.Unlock()
+		log.Printf("Failed to reload settings, keeping the current ones: %v", err)
+		return fmt.Errorf("invalid settings: %w", err)
+	}
+	if migrated {
+		if err = writeSettingsData(data); err != nil {
+			Settings.mutex.Unlock()
+			log.Printf("Failed to save reloaded settings, keeping the current ones: %e", err)
+			return err
+		}
+	}
+	previousCron := Settings.Cron
+	Settings.Version = data.Version
+	Settings.Cron = data.Cron
+	Settings.Guilds = data.Guilds
+	Settings.mutex.Unlock()
+
+	// until the channel caches are filled the filters match the channels without them
+	for guild, settings := range data.Guilds {
+		if _, err := s.State.Guild(guild); err != nil {
+			continue
+		}
+		for _, track := range settings.Tracks {
+			track.metricChannelFilter.updateCache(s, guild)
+		}
+	}
+
+	if data.Cron != previousCron {
+		if err = scheduler.reschedule(data.Cron); err != nil {
+			log.Println(err)
+		}
+	}
+	refreshSettingsPanels(s)
+
+	log.Println("Settings reloaded.")
+	return nil
+}
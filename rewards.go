@@ -1,90 +1,387 @@
 package main
 
 import (
+	"bytes"
 	"cmp"
+	"encoding/gob"
+	"fmt"
 	"log"
+	"maps"
 	"slices"
+	"sync"
+	"time"
+
+	mapset "github.com/deckarep/golang-set/v2"
 )
 
 type pair struct {
 	User string
-	Val  int64
+	Val  float64
+	Rank int
+}
+
+// ranking sorts the users by score and assigns competition ranks, so users with equal scores share a rank
+// and the following rank is skipped. Users with a score below 1 are not ranked.
+func ranking(scores map[string]float64) []pair {
+	var ranked []pair
+	for user, val := range scores {
+		if val < 1 {
+			continue
+		}
+		ranked = append(ranked, pair{User: user, Val: val})
+	}
+
+	slices.SortFunc(ranked, func(i pair, j pair) int {
+		if c := cmp.Compare(j.Val, i.Val); c != 0 {
+			return c
+		}
+		return cmp.Compare(i.User, j.User)
+	})
+
+	for i := range ranked {
+		if i > 0 && ranked[i].Val == ranked[i-1].Val {
+			ranked[i].Rank = ranked[i-1].Rank
+		} else {
+			ranked[i].Rank = i + 1
+		}
+	}
+	return ranked
 }
 
 func updateRewards() {
-	medians := analyzeMetrics()
+	for _, guild := range joinedGuilds() {
+		updateGuildRewards(guild)
+	}
+}
+
+// RoleTargets contain the users qualifying to gain a reward role and the users qualifying to keep it.
+// Members below the keep threshold lose the role after the grace period.
+type RoleTargets struct {
+	Gain  mapset.Set[string]
+	Keep  mapset.Set[string]
+	Grace time.Duration
+	// Scores contains the score of each user the role was decided on.
+	Scores map[string]float64
+}
 
-	var sortedMedians []pair
-	for user, val := range medians {
-		sortedMedians = append(sortedMedians, pair{user, val})
+func newRoleTargets(grace time.Duration) *RoleTargets {
+	return &RoleTargets{
+		Gain:   mapset.NewSet[string](),
+		Keep:   mapset.NewSet[string](),
+		Grace:  grace,
+		Scores: map[string]float64{},
 	}
+}
 
-	slices.SortFunc(sortedMedians, func(i pair, j pair) int {
-		return cmp.Compare(j.Val, i.Val)
-	})
+// computeTrackRewards ranks the users of a track and determines which users qualify for the reward roles of the track.
+func computeTrackRewards(guild string, name string) ([]pair, map[string]*RoleTargets) {
+	settings := guildSettings(guild)
+	track := settings.track(name)
+	windows := trackMetrics(guild, name).windows()
+	for user := range windows {
+		if settings.Exclusions.excludesCached(guild, user) {
+			delete(windows, user)
+		}
+	}
+	ranked := ranking(aggregate(windows, Aggregation{Function: AggregationMedian}))
+
+	targetRoles := map[string]*RoleTargets{}
+	for _, rank := range track.RankRoles {
+		targetRoles[rank.Role] = newRoleTargets(rank.grace())
+	}
+	for role, reward := range track.RewardRoles {
+		targets := newRoleTargets(reward.grace())
+		targetRoles[role] = targets
+
+		for user, score := range aggregate(windows, reward.Aggregation) {
+			if score <= 0 {
+				continue
+			}
+			targets.Scores[user] = score
+			if score >= float64(reward.Target) {
+				targets.Gain.Add(user)
+				targets.Keep.Add(user)
+			}
+			if score >= float64(reward.keepTarget()) {
+				targets.Keep.Add(user)
+			}
+		}
+	}
+
+	for _, entry := range ranked {
+		for _, rank := range track.RankRoles {
+			targets := targetRoles[rank.Role]
+			targets.Scores[entry.User] = entry.Val
+			if entry.Rank >= rank.From && entry.Rank <= rank.To {
+				targets.Gain.Add(entry.User)
+				targets.Keep.Add(entry.User)
+			}
+			if entry.Rank >= rank.From && entry.Rank <= rank.keepTo() {
+				targets.Keep.Add(entry.User)
+			}
+		}
+	}
+
+	return ranked, targetRoles
+}
+
+// computeRewards determines which users qualify for which reward roles in any track of the guild.
+// A role used by several tracks is granted to the qualifying users of all of them.
+func computeRewards(guild string) map[string]*RoleTargets {
+	targetRoles := map[string]*RoleTargets{}
+	for _, name := range guildSettings(guild).trackNames() {
+		_, trackTargets := computeTrackRewards(guild, name)
+		for role, targets := range trackTargets {
+			merged, ok := targetRoles[role]
+			if !ok {
+				targetRoles[role] = targets
+				continue
+			}
+			merged.Gain.Append(targets.Gain.ToSlice()...)
+			merged.Keep.Append(targets.Keep.ToSlice()...)
+			merged.Grace = max(merged.Grace, targets.Grace)
+			for user, score := range targets.Scores {
+				merged.Scores[user] = max(merged.Scores[user], score)
+			}
+		}
+	}
+	return targetRoles
+}
+
+// RewardState contains the state of reward roles which has to survive restarts.
+type RewardState struct {
+	mutex sync.Mutex
+	guild string
+	// Grace maps roles to users to the time they fell below the keep threshold.
+	Grace map[string]map[string]time.Time
+	// History maps users to the reward role changes applied to them, oldest first.
+	History map[string][]RewardEvent
+	// OptOut contains the users who do not want to be congratulated on new roles.
+	OptOut map[string]bool
+}
+
+var RewardStates = struct {
+	mutex  sync.Mutex
+	Guilds map[string]*RewardState
+}{
+	Guilds: map[string]*RewardState{},
+}
+
+func rewardStateKey(guild string) string {
+	return fmt.Sprintf("rewards_%s.gob", guild)
+}
+
+// guildRewardState returns the reward state of the given guild and loads it on first access.
+func guildRewardState(guild string) *RewardState {
+	RewardStates.mutex.Lock()
+	defer RewardStates.mutex.Unlock()
 
-	targetRoles := map[string]*[]string{
-		Settings.KingsRole: {},
+	state, ok := RewardStates.Guilds[guild]
+	if !ok {
+		state = &RewardState{
+			guild:   guild,
+			Grace:   map[string]map[string]time.Time{},
+			History: map[string][]RewardEvent{},
+			OptOut:  map[string]bool{},
+		}
+		b, err := store.Load(rewardStateKey(guild))
+		if err == nil {
+			err = gob.NewDecoder(bytes.NewBuffer(b)).Decode(state)
+		}
+		if err != nil && err != ErrNotStored {
+			log.Printf("Failed to load reward state of guild %s: %e", guild, err)
+		}
+		if state.History == nil {
+			state.History = map[string][]RewardEvent{}
+		}
+		if state.OptOut == nil {
+			state.OptOut = map[string]bool{}
+		}
+		RewardStates.Guilds[guild] = state
+	}
+	return state
+}
+
+func (r *RewardState) store() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(r); err != nil {
+		log.Printf("Failed to save reward state! %e", err)
+		return
+	}
+	if err := store.Save(rewardStateKey(r.guild), b.Bytes()); err != nil {
+		log.Printf("Failed to save reward state! %e", err)
+	}
+}
+
+func (r *RewardState) clone() *RewardState {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	clone := &RewardState{
+		guild:   r.guild,
+		Grace:   map[string]map[string]time.Time{},
+		History: map[string][]RewardEvent{},
+		OptOut:  maps.Clone(r.OptOut),
+	}
+	for role, users := range r.Grace {
+		clone.Grace[role] = maps.Clone(users)
+	}
+	for user, events := range r.History {
+		clone.History[user] = slices.Clone(events)
+	}
+	return clone
+}
+
+// forget drops the grace period of a user who left the guild.
+func (r *RewardState) forget(role string, user string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.Grace[role], user)
+}
+
+// shouldHaveRole decides whether the user should have the role, starting or ending the grace period as needed.
+func (r *RewardState) shouldHaveRole(role string, targets *RoleTargets, user string, hasRole bool, now time.Time) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !hasRole || targets.Keep.Contains(user) {
+		delete(r.Grace[role], user)
+		return targets.Gain.Contains(user) || (hasRole && targets.Keep.Contains(user))
+	}
+
+	if targets.Grace <= 0 {
+		return false
+	}
+
+	users, ok := r.Grace[role]
+	if !ok {
+		users = map[string]time.Time{}
+		r.Grace[role] = users
 	}
-	for role := range Settings.RewardRole {
-		targetRoles[role] = &[]string{}
+	since, ok := users[user]
+	if !ok {
+		users[user] = now
+		return true
+	}
+	if now.Sub(since) < targets.Grace {
+		return true
+	}
+	delete(users, user)
+	return false
+}
+
+// RoleChange is a reward role to add to or remove from a member.
+type RoleChange struct {
+	Role  string
+	User  string
+	Add   bool
+	Score float64
+}
+
+// planRewards determines the role changes of the guild based on the cached member roles,
+// so only members whose roles change cause requests. Grace periods are tracked in the given state.
+func planRewards(guild string, state *RewardState) ([]RoleChange, error) {
+	members := guildMembers(guild)
+	if err := members.ensureLoaded(dg); err != nil {
+		return nil, err
 	}
 
-	for i, entry := range sortedMedians {
-		if entry.Val < 1 {
+	targetRoles := computeRewards(guild)
+	now := time.Now()
+
+	var changes []RoleChange
+	for role, targets := range targetRoles {
+		if role == "" {
 			continue
 		}
 
-		if i < 6 {
-			kings := targetRoles[Settings.KingsRole]
-			*kings = append(*kings, entry.User)
+		candidates := targets.Gain.Clone()
+		candidates.Append(members.roleMembers(role)...)
+		state.mutex.Lock()
+		for user := range state.Grace[role] {
+			candidates.Add(user)
 		}
+		state.mutex.Unlock()
+
+		for user := range candidates.Iter() {
+			hasRole, isMember := members.hasRole(user, role)
+			if !isMember {
+				state.forget(role, user)
+				continue
+			}
+			shouldHaveRole := state.shouldHaveRole(role, targets, user, hasRole, now)
 
-		for role, target := range Settings.RewardRole {
-			if entry.Val >= target {
-				targetRole := targetRoles[role]
-				*targetRole = append(*targetRole, entry.User)
+			if shouldHaveRole != hasRole {
+				changes = append(changes, RoleChange{Role: role, User: user, Add: shouldHaveRole, Score: targets.Scores[user]})
 			}
 		}
 	}
 
-	after := ""
-	for {
-		batch, err := dg.GuildMembers(guild, after, 1000)
-		if err != nil {
-			log.Printf("Failed to get guild members: %e", err)
-			break
+	slices.SortFunc(changes, func(a, b RoleChange) int {
+		if c := cmp.Compare(a.Role, b.Role); c != 0 {
+			return c
 		}
-		if len(batch) == 0 {
-			break
-		}
-		after = batch[len(batch)-1].User.ID
+		return cmp.Compare(a.User, b.User)
+	})
+	return changes, nil
+}
 
-		for _, member := range batch {
-			for role, users := range targetRoles {
-				if role == "" {
-					continue
-				}
+// previewRewards determines the role changes of the guild without touching the grace periods.
+func previewRewards(guild string) ([]RoleChange, error) {
+	return planRewards(guild, guildRewardState(guild).clone())
+}
+
+func updateGuildRewards(guild string) {
+	state := guildRewardState(guild)
+	if dryRun {
+		state = state.clone()
+	}
 
-				shouldHaveRole := slices.Contains(*users, member.User.ID)
-				hasRole := slices.Contains(member.Roles, role)
+	changes, err := planRewards(guild, state)
+	if err != nil {
+		log.Printf("Failed to get members of guild %s: %e", guild, err)
+		return
+	}
 
-				if shouldHaveRole && !hasRole {
-					err := dg.GuildMemberRoleAdd(guild, member.User.ID, role)
-					if err != nil {
-						log.Printf("Failed to add role %s to %s: %e", role, member.User.ID, err)
-					}
-				} else if !shouldHaveRole && hasRole {
-					err := dg.GuildMemberRoleRemove(guild, member.User.ID, role)
-					if err != nil {
-						log.Printf("Failed to remove role %s from %s: %e", role, member.User.ID, err)
-					}
-				}
+	members := guildMembers(guild)
+	var applied []RoleChange
+	for _, change := range changes {
+		if dryRun {
+			if change.Add {
+				log.Printf("Dry run: would add role %s to %s.", change.Role, change.User)
+			} else {
+				log.Printf("Dry run: would remove role %s from %s.", change.Role, change.User)
 			}
+			continue
 		}
 
-		if len(batch) < 1000 {
-			break
+		if change.Add {
+			err := dg.GuildMemberRoleAdd(guild, change.User, change.Role)
+			if err != nil {
+				log.Printf("Failed to add role %s to %s: %e", change.Role, change.User, err)
+				continue
+			}
+			members.addRole(change.User, change.Role)
+			applied = append(applied, change)
+		} else {
+			err := dg.GuildMemberRoleRemove(guild, change.User, change.Role)
+			if err != nil {
+				log.Printf("Failed to remove role %s from %s: %e", change.Role, change.User, err)
+				continue
+			}
+			members.removeRole(change.User, change.Role)
+			applied = append(applied, change)
 		}
 	}
+
+	if !dryRun {
+		state.record(applied, time.Now())
+		state.store()
+		postAuditLog(guild, applied)
+		announceRewards(guild, state, applied)
+	}
 }
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/robfig/cron"
+)
+
+// Job is a task run periodically by the scheduler. A run is skipped while the previous run is still running.
+type Job struct {
+	Name        string
+	Description string
+	run         func()
+	// schedule returns the field of the cron settings holding the schedule of the job.
+	schedule func(schedules *CronSettings) *string
+
+	scheduler *Scheduler
+	running   sync.Mutex
+
+	mutex        sync.Mutex
+	lastRun      time.Time
+	lastDuration time.Duration
+}
+
+// Run runs the job unless it is still running, it is called by cron.
+func (j *Job) Run() {
+	if !j.running.TryLock() {
+		log.Printf("Skipping job %s, the previous run is still running.", j.Name)
+		return
+	}
+	defer j.running.Unlock()
+
+	if !j.scheduler.add() {
+		return
+	}
+	defer j.scheduler.wg.Done()
+
+	j.execute()
+}
+
+// start runs the job in the background unless it is still running and tells whether it was started.
+func (j *Job) start() bool {
+	if !j.running.TryLock() {
+		return false
+	}
+
+	started := j.scheduler.background(func() {
+		defer j.running.Unlock()
+
+		j.execute()
+	})
+	if !started {
+		j.running.Unlock()
+	}
+	return started
+}
+
+func (j *Job) execute() {
+	start := time.Now()
+	j.run()
+	duration := time.Since(start)
+
+	j.mutex.Lock()
+	j.lastRun = start
+	j.lastDuration = duration
+	j.mutex.Unlock()
+}
+
+// isRunning tells whether the job is running right now.
+func (j *Job) isRunning() bool {
+	if !j.running.TryLock() {
+		return true
+	}
+	j.running.Unlock()
+	return false
+}
+
+// Scheduler runs the jobs on the schedules of the cron settings.
+type Scheduler struct {
+	mutex sync.Mutex
+	cron  *cron.Cron
+	jobs  []*Job
+	// stopped is set once the scheduler is stopped, no schedules or work are started afterwards.
+	stopped bool
+	// wg counts the running jobs and background work.
+	wg sync.WaitGroup
+}
+
+func newScheduler(jobs ...*Job) *Scheduler {
+	s := &Scheduler{jobs: jobs}
+	for _, job := range jobs {
+		job.scheduler = s
+	}
+	return s
+}
+
+var scheduler = newScheduler(
+	&Job{
+		Name:        "CumulationStep",
+		Description: "Prunes the metrics of days no longer tracked.",
+		run:         pruneMetrics,
+		schedule:    func(schedules *CronSettings) *string { return &schedules.CumulationStep },
+	},
+	&Job{
+		Name:        "SaveMetrics",
+		Description: "Saves the metrics of all tracks.",
+		run:         storeMetrics,
+		schedule:    func(schedules *CronSettings) *string { return &schedules.SaveMetrics },
+	},
+	&Job{
+		Name:        "UpdateRewards",
+		Description: "Grants and removes the reward and ranking roles.",
+		run:         updateRewards,
+		schedule:    func(schedules *CronSettings) *string { return &schedules.UpdateRewards },
+	},
+	&Job{
+		Name:        "ReconcileMembers",
+		Description: "Replaces the cached member roles with the full member list.",
+		run:         reconcileMembers,
+		schedule:    func(schedules *CronSettings) *string { return &schedules.ReconcileMembers },
+	},
+)
+
+// parseSchedule parses a standard cron expression with 5 fields starting with the minutes,
+// an expression with 6 fields starting with the seconds or a descriptor like @hourly.
+// cron.Parse alone reads 5 fields as seconds to months, so "*/5 * * * *" would run every 5 seconds.
+func parseSchedule(spec string) (cron.Schedule, error) {
+	if len(strings.Fields(spec)) == 5 {
+		return cron.ParseStandard(spec)
+	}
+	return cron.Parse(spec)
+}
+
+// reschedule replaces the running schedules by the given ones.
+// If a schedule is invalid the current schedules keep running.
+func (s *Scheduler) reschedule(schedules CronSettings) error {
+	c := cron.New()
+	for _, job := range s.jobs {
+		schedule, err := parseSchedule(*job.schedule(&schedules))
+		if err != nil {
+			return fmt.Errorf("invalid schedule of job %s: %w", job.Name, err)
+		}
+		c.Schedule(schedule, job)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopped {
+		return nil
+	}
+	if s.cron != nil {
+		s.cron.Stop()
+	}
+	s.cron = c
+	s.cron.Start()
+	return nil
+}
+
+// add counts work that is about to run unless the scheduler is stopped.
+// The caller must call wg.Done when the work is finished.
+func (s *Scheduler) add() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stopped {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+// background runs work outside of the jobs, like a backfill, so shutting down waits for it.
+// It tells whether the work was started, nothing is started once the scheduler is stopped.
+func (s *Scheduler) background(run func()) bool {
+	if !s.add() {
+		return false
+	}
+	go func() {
+		defer s.wg.Done()
+		run()
+	}()
+	return true
+}
+
+// stop stops scheduling the jobs, running jobs are not interrupted.
+// Later calls to reschedule and background do nothing.
+func (s *Scheduler) stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.stopped = true
+	if s.cron != nil {
+		s.cron.Stop()
+		s.cron = nil
+	}
+}
+
+// wait waits for the running jobs to finish and tells whether they finished within the timeout.
+func (s *Scheduler) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (s *Scheduler) job(name string) *Job {
+	for _, job := range s.jobs {
+		if job.Name == name {
+			return job
+		}
+	}
+	return nil
+}
+
+// nextRuns returns the time of the next run of every scheduled job.
+func (s *Scheduler) nextRuns() map[*Job]time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	next := map[*Job]time.Time{}
+	if s.cron == nil {
+		return next
+	}
+	for _, entry := range s.cron.Entries() {
+		if job, ok := entry.Job.(*Job); ok {
+			next[job] = entry.Next
+		}
+	}
+	return next
+}
+
+func createSchedule() []discordgo.MessageComponent {
+	schedules := cronSettings()
+	next := scheduler.nextRuns()
+
+	var msg strings.Builder
+	msg.WriteString("# Schedule\n")
+	var jobOptions []discordgo.SelectMenuOption
+	for _, job := range scheduler.jobs {
+		msg.WriteString(fmt.Sprintf("**%s:** `%s`", job.Name, *job.schedule(&schedules)))
+		if t, ok := next[job]; ok && !t.IsZero() {
+			msg.WriteString(fmt.Sprintf(", next run <t:%d:R>", t.Unix()))
+		}
+		job.mutex.Lock()
+		if !job.lastRun.IsZero() {
+			msg.WriteString(fmt.Sprintf(", last run <t:%d:R> took %s", job.lastRun.Unix(), job.lastDuration.Round(time.Millisecond)))
+		}
+		job.mutex.Unlock()
+		if job.isRunning() {
+			msg.WriteString(", **running**")
+		}
+		msg.WriteString(fmt.Sprintf("\n-# %s\n", job.Description))
+
+		jobOptions = append(jobOptions, discordgo.SelectMenuOption{
+			Label: job.Name,
+			Value: job.Name,
+		})
+	}
+
+	return []discordgo.MessageComponent{
+		discordgo.TextDisplay{
+			Content: msg.String(),
+		},
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					MenuType:    discordgo.StringSelectMenu,
+					CustomID:    "run_job",
+					Placeholder: "Run now",
+					Options:     jobOptions,
+				},
+			},
+		},
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Edit Schedule",
+					Style:    discordgo.SecondaryButton,
+					CustomID: "edit_schedule",
+				},
+				discordgo.Button{
+					Label:    "Refresh",
+					Style:    discordgo.SecondaryButton,
+					CustomID: "show_schedule",
+				},
+			},
+		},
+	}
+}
+
+func updateScheduleMessage(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Components:      createSchedule(),
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+			Flags:           discordgo.MessageFlagsIsComponentsV2 | discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// denyOutsideControlGuild responds with an error and returns true if the interaction is not from the control guild,
+// the jobs run for all guilds and must not be controlled by the admins of any guild.
+func denyOutsideControlGuild(s *discordgo.Session, i *discordgo.InteractionCreate) bool {
+	if isControlGuild(i.GuildID) {
+		return false
+	}
+
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: "The jobs run for all guilds and can only be controlled from the control guild.",
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return true
+}
+
+func init() {
+	controlCommands["alice_schedule"] = true
+
+	maps.Copy(commands, map[*discordgo.ApplicationCommand]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+		{
+			Name:                     "alice_schedule",
+			Description:              "Shows the schedule of the periodic jobs of all guilds and runs them on demand.",
+			Type:                     discordgo.ChatApplicationCommand,
+			DefaultMemberPermissions: i64(0),
+		}: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			if denyOutsideControlGuild(s, i) {
+				return
+			}
+
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Components:      createSchedule(),
+					AllowedMentions: &discordgo.MessageAllowedMentions{},
+					Flags:           discordgo.MessageFlagsIsComponentsV2 | discordgo.MessageFlagsEphemeral,
+				},
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		},
+	})
+
+	maps.Copy(messageComponents, map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+		"show_schedule": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			if denyOutsideControlGuild(s, i) {
+				return
+			}
+
+			updateScheduleMessage(s, i)
+		},
+		"run_job": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			if denyOutsideControlGuild(s, i) {
+				return
+			}
+
+			job := scheduler.job(i.MessageComponentData().Values[0])
+			if job == nil {
+				return
+			}
+
+			if job.start() {
+				log.Printf("Running job %s on demand.", job.Name)
+			}
+
+			updateScheduleMessage(s, i)
+		},
+		"edit_schedule": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			if denyOutsideControlGuild(s, i) {
+				return
+			}
+
+			schedules := cronSettings()
+
+			var rows []discordgo.MessageComponent
+			for _, job := range scheduler.jobs {
+				rows = append(rows, discordgo.ActionsRow{
+					Components: []discordgo.MessageComponent{
+						discordgo.TextInput{
+							Label:       job.Name,
+							Placeholder: "Cron expression like */5 * * * * or a descriptor like @hourly",
+							Value:       *job.schedule(&schedules),
+							Style:       discordgo.TextInputShort,
+							Required:    true,
+							CustomID:    job.Name,
+						},
+					},
+				})
+			}
+
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseModal,
+				Data: &discordgo.InteractionResponseData{
+					Title:      "Edit Schedule",
+					Components: rows,
+					CustomID:   "edit_schedule",
+				},
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		},
+	})
+
+	maps.Copy(modals, map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, ids []string){
+		"edit_schedule": func(s *discordgo.Session, i *discordgo.InteractionCreate, ids []string) {
+			if denyOutsideControlGuild(s, i) {
+				return
+			}
+
+			values := map[string]string{}
+			for _, row := range i.ModalSubmitData().Components {
+				input := row.(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput)
+				values[input.CustomID] = strings.TrimSpace(input.Value)
+			}
+
+			err := updateCronSettings(func(schedules *CronSettings) error {
+				for _, job := range scheduler.jobs {
+					value, ok := values[job.Name]
+					if !ok {
+						continue
+					}
+					if _, err := parseSchedule(value); err != nil {
+						return err
+					}
+					*job.schedule(schedules) = value
+				}
+				return nil
+			})
+			if err != nil {
+				return
+			}
+			if err = scheduler.reschedule(cronSettings()); err != nil {
+				log.Println(err)
+			}
+
+			updateScheduleMessage(s, i)
+		},
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		spec     string
+		interval time.Duration
+	}{
+		{"*/5 * * * *", 5 * time.Minute},
+		{"0 */10 * * * *", 10 * time.Minute},
+		{"*/30 * * * * *", 30 * time.Second},
+		{"@hourly", time.Hour},
+	}
+
+	for _, test := range tests {
+		schedule, err := parseSchedule(test.spec)
+		if err != nil {
+			t.Errorf("parseSchedule(%q) failed: %s", test.spec, err)
+			continue
+		}
+		next := schedule.Next(start)
+		if interval := schedule.Next(next).Sub(next); interval != test.interval {
+			t.Errorf("%q runs every %s, want every %s", test.spec, interval, test.interval)
+		}
+	}
+
+	if _, err := parseSchedule("* * *"); err == nil {
+		t.Error("parseSchedule accepted an expression with 3 fields")
+	}
+}
+
+func TestDefaultSchedules(t *testing.T) {
+	defaults := defaultCronSettings()
+	for _, job := range scheduler.jobs {
+		spec := *job.schedule(&defaults)
+		schedule, err := parseSchedule(spec)
+		if err != nil {
+			t.Errorf("the default schedule %q of job %s is invalid: %s", spec, job.Name, err)
+			continue
+		}
+		next := schedule.Next(time.Now())
+		if interval := schedule.Next(next).Sub(next); interval < time.Minute {
+			t.Errorf("job %s runs every %s by default, at most once a minute is intended", job.Name, interval)
+		}
+	}
+}
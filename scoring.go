@@ -0,0 +1,252 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// LengthPoints are the points a message earns if its content is at least MinLength characters long.
+type LengthPoints struct {
+	MinLength int
+	Points    int64
+}
+
+type ScoringSettings struct {
+	LengthPoints        []LengthPoints
+	AttachmentPoints    int64
+	ReplyPoints         int64
+	ThreadStarterPoints int64
+	ChannelMultipliers  map[string]float64
+}
+
+func defaultScoringSettings() ScoringSettings {
+	return ScoringSettings{
+		LengthPoints:       []LengthPoints{{MinLength: 0, Points: 1}},
+		ChannelMultipliers: map[string]float64{},
+	}
+}
+
+func (s ScoringSettings) clone() ScoringSettings {
+	s.LengthPoints = slices.Clone(s.LengthPoints)
+	s.ChannelMultipliers = maps.Clone(s.ChannelMultipliers)
+	return s
+}
+
+var customEmojiRegex = regexp.MustCompile(`<a?:\w+:\d+>`)
+
+// contentLength counts the letters and digits of the message content, so emojis and punctuation do not count.
+func contentLength(content string) int {
+	content = customEmojiRegex.ReplaceAllString(content, "")
+	length := 0
+	for _, r := range content {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			length++
+		}
+	}
+	return length
+}
+
+func (s *ScoringSettings) score(m *discordgo.Message, channel *discordgo.Channel) int64 {
+	var points int64 = 0
+
+	length := contentLength(m.Content)
+	minLength := -1
+	for _, entry := range s.LengthPoints {
+		if length >= entry.MinLength && entry.MinLength > minLength {
+			minLength = entry.MinLength
+			points = entry.Points
+		}
+	}
+
+	if len(m.Attachments) > 0 {
+		points += s.AttachmentPoints
+	}
+	if m.ReferencedMessage != nil && m.ReferencedMessage.Author != nil && m.ReferencedMessage.Author.ID != m.Author.ID {
+		points += s.ReplyPoints
+	}
+	if m.Type == discordgo.MessageTypeThreadCreated || m.ID == m.ChannelID {
+		points += s.ThreadStarterPoints
+	}
+
+	if multiplier, ok := s.channelMultiplier(channel); ok {
+		points = int64(math.Round(float64(points) * multiplier))
+	}
+
+	return points
+}
+
+// channelMultiplier returns the multiplier of the channel. Threads and forum posts use the one of their parent channel
+// unless they have their own.
+func (s *ScoringSettings) channelMultiplier(channel *discordgo.Channel) (float64, bool) {
+	if multiplier, ok := s.ChannelMultipliers[channel.ID]; ok {
+		return multiplier, true
+	}
+	if channel.IsThread() {
+		multiplier, ok := s.ChannelMultipliers[channel.ParentID]
+		return multiplier, ok
+	}
+	return 0, false
+}
+
+func formatLengthPoints(lengthPoints []LengthPoints) string {
+	var parts []string
+	for _, entry := range lengthPoints {
+		parts = append(parts, fmt.Sprintf("%d:%d", entry.MinLength, entry.Points))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseLengthPoints parses a list like "0:0, 10:1, 50:2" of minimum lengths and their points.
+func parseLengthPoints(value string) ([]LengthPoints, error) {
+	var lengthPoints []LengthPoints
+	for _, part := range strings.Split(value, ",") {
+		minLength, points, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid length points %q", part)
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(minLength))
+		if err != nil {
+			return nil, err
+		}
+		p, err := strconv.ParseInt(strings.TrimSpace(points), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		lengthPoints = append(lengthPoints, LengthPoints{MinLength: length, Points: p})
+	}
+	slices.SortFunc(lengthPoints, func(a, b LengthPoints) int {
+		return cmp.Compare(a.MinLength, b.MinLength)
+	})
+	return lengthPoints, nil
+}
+
+func scoringTextInput(label string, customID string, value string) discordgo.ActionsRow {
+	return discordgo.ActionsRow{
+		Components: []discordgo.MessageComponent{
+			discordgo.TextInput{
+				Label:    label,
+				Style:    discordgo.TextInputShort,
+				Value:    value,
+				Required: true,
+				CustomID: customID,
+			},
+		},
+	}
+}
+
+func init() {
+	maps.Copy(messageComponents, map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+		"edit_scoring": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			scoring := guildSettings(i.GuildID).Scoring
+
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseModal,
+				Data: &discordgo.InteractionResponseData{
+					Title: "Edit Scoring",
+					Components: []discordgo.MessageComponent{
+						scoringTextInput("Points by Length (min length:points, ...)", "length_points", formatLengthPoints(scoring.LengthPoints)),
+						scoringTextInput("Attachment Points", "attachment_points", strconv.FormatInt(scoring.AttachmentPoints, 10)),
+						scoringTextInput("Reply Points", "reply_points", strconv.FormatInt(scoring.ReplyPoints, 10)),
+						scoringTextInput("Thread Starter Points", "thread_starter_points", strconv.FormatInt(scoring.ThreadStarterPoints, 10)),
+					},
+					CustomID: "edit_scoring",
+				},
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		},
+		"set_channel_multiplier": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			channel := i.MessageComponentData().Values[0]
+			multiplier, ok := guildSettings(i.GuildID).Scoring.ChannelMultipliers[channel]
+			if !ok {
+				multiplier = 1
+			}
+
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseModal,
+				Data: &discordgo.InteractionResponseData{
+					Title: "Set Channel Multiplier",
+					Components: []discordgo.MessageComponent{
+						scoringTextInput("Multiplier (1 to reset)", "multiplier", strconv.FormatFloat(multiplier, 'g', -1, 64)),
+					},
+					CustomID: fmt.Sprintf("set_channel_multiplier|%s", channel),
+				},
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		},
+	})
+
+	maps.Copy(modals, map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, ids []string){
+		"edit_scoring": func(s *discordgo.Session, i *discordgo.InteractionCreate, ids []string) {
+			values := map[string]string{}
+			for _, row := range i.ModalSubmitData().Components {
+				input := row.(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput)
+				values[input.CustomID] = input.Value
+			}
+
+			lengthPoints, err := parseLengthPoints(values["length_points"])
+			if err != nil {
+				return
+			}
+			attachmentPoints, err := strconv.ParseInt(values["attachment_points"], 10, 64)
+			if err != nil {
+				return
+			}
+			replyPoints, err := strconv.ParseInt(values["reply_points"], 10, 64)
+			if err != nil {
+				return
+			}
+			threadStarterPoints, err := strconv.ParseInt(values["thread_starter_points"], 10, 64)
+			if err != nil {
+				return
+			}
+
+			err = updateGuildSettings(i.GuildID, func(settings *GuildSettings) error {
+				settings.Scoring.LengthPoints = lengthPoints
+				settings.Scoring.AttachmentPoints = attachmentPoints
+				settings.Scoring.ReplyPoints = replyPoints
+				settings.Scoring.ThreadStarterPoints = threadStarterPoints
+				return nil
+			})
+			if err != nil {
+				return
+			}
+
+			updateSettingsMessage(s, i)
+		},
+		"set_channel_multiplier": func(s *discordgo.Session, i *discordgo.InteractionCreate, ids []string) {
+			var multiplierStr = i.ModalSubmitData().Components[0].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value
+			multiplier, err := strconv.ParseFloat(multiplierStr, 64)
+			if err != nil || multiplier < 0 {
+				return
+			}
+
+			err = updateGuildSettings(i.GuildID, func(settings *GuildSettings) error {
+				if multiplier == 1 {
+					delete(settings.Scoring.ChannelMultipliers, ids[1])
+				} else {
+					settings.Scoring.ChannelMultipliers[ids[1]] = multiplier
+				}
+				return nil
+			})
+			if err != nil {
+				return
+			}
+
+			updateSettingsMessage(s, i)
+		},
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestScoreChannelMultipliers(t *testing.T) {
+	scoring := defaultScoringSettings()
+	scoring.LengthPoints = []LengthPoints{{MinLength: 0, Points: 10}}
+	scoring.ChannelMultipliers = map[string]float64{
+		"300000000000000001": 2,
+		"300000000000000003": 0.5,
+	}
+
+	channel := &discordgo.Channel{ID: "300000000000000001", Type: discordgo.ChannelTypeGuildText}
+	forum := &discordgo.Channel{ID: "300000000000000002", Type: discordgo.ChannelTypeGuildForum}
+	tests := []struct {
+		name    string
+		channel *discordgo.Channel
+		points  int64
+	}{
+		{"channel", channel, 20},
+		{"other channel", forum, 10},
+		{"thread of channel", &discordgo.Channel{ID: "300000000000000004", ParentID: channel.ID, Type: discordgo.ChannelTypeGuildPublicThread}, 20},
+		{"thread with own multiplier", &discordgo.Channel{ID: "300000000000000003", ParentID: channel.ID, Type: discordgo.ChannelTypeGuildPublicThread}, 5},
+		{"forum post", &discordgo.Channel{ID: "300000000000000005", ParentID: forum.ID, Type: discordgo.ChannelTypeGuildPublicThread}, 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &discordgo.Message{ID: "600000000000000001", ChannelID: test.channel.ID, Content: "hello", Author: &discordgo.User{ID: "400000000000000001"}}
+			if points := scoring.score(m, test.channel); points != test.points {
+				t.Errorf("score returned %d points, want %d", points, test.points)
+			}
+		})
+	}
+}
@@ -1,81 +1,515 @@
 package main
 
 import (
+	"cmp"
 	"fmt"
 	"log"
 	"maps"
-	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
-	mapset "github.com/deckarep/golang-set/v2"
 	"github.com/pelletier/go-toml"
 )
 
 type CronSettings struct {
-	SaveMetrics    string
-	UpdateRewards  string
+	SaveMetrics   string
+	UpdateRewards string
+	// CumulationStep prunes metrics of days no longer tracked, the days themselves follow the calendar.
 	CumulationStep string
+	// ReconcileMembers replaces the cached member roles with the full member list.
+	ReconcileMembers string
 }
 
-var Settings = struct {
-	NumTrackedDays      int
-	metricChannelFilter ChannelFilter
-	KingsRole           string
-	RewardRole          map[string]int64
+// RewardRoleSettings grant a role to everyone whose aggregated score reaches the target.
+// Members keep the role as long as they stay above KeepTarget and lose it after staying below for GraceHours.
+type RewardRoleSettings struct {
+	Target      int64
+	KeepTarget  int64
+	GraceHours  int
+	Aggregation Aggregation
+}
+
+func (r *RewardRoleSettings) keepTarget() int64 {
+	if r.KeepTarget <= 0 || r.KeepTarget > r.Target {
+		return r.Target
+	}
+	return r.KeepTarget
+}
+
+func (r *RewardRoleSettings) grace() time.Duration {
+	return time.Duration(r.GraceHours) * time.Hour
+}
+
+// RankRoleSettings grant a role to everyone ranked between From and To (inclusive, starting with 1) by median.
+// Members keep the role as long as they are ranked up to KeepTo and lose it after being ranked lower for GraceHours.
+type RankRoleSettings struct {
+	Role       string
+	From       int
+	To         int
+	KeepTo     int
+	GraceHours int
+}
+
+func (r *RankRoleSettings) keepTo() int {
+	return max(r.KeepTo, r.To)
+}
+
+func (r *RankRoleSettings) grace() time.Duration {
+	return time.Duration(r.GraceHours) * time.Hour
+}
 
-	Cron CronSettings
+// DefaultTrack is the track the settings of previous versions are migrated to, it cannot be removed.
+const DefaultTrack = "default"
+
+// TrackSettings describe an independent competition with its own channels, metrics and reward roles.
+type TrackSettings struct {
+	metricChannelFilter ChannelFilter
+	RankRoles           []*RankRoleSettings
+	RewardRoles         map[string]*RewardRoleSettings
+	// SeriesWeights combines the metric series into the score used for rewards.
+	SeriesWeights map[string]float64
 
 	MetricChannelFilterSerialized *SerializedChannelFilter `toml:"MetricChannels"`
+}
+
+func newTrackSettings() *TrackSettings {
+	return &TrackSettings{
+		metricChannelFilter:           newChannelFilter(),
+		RankRoles:                     []*RankRoleSettings{},
+		RewardRoles:                   map[string]*RewardRoleSettings{},
+		SeriesWeights:                 defaultSeriesWeights(),
+		MetricChannelFilterSerialized: nil,
+	}
+}
+
+type GuildSettings struct {
+	NumTrackedDays int
+	// Timezone is the IANA name of the timezone the days of the metrics are aligned to.
+	Timezone string
+	// timezone is the location of Timezone, see resolveLocation.
+	timezone *time.Location
+	// Tracks maps the names of the tracks to their settings.
+	Tracks  map[string]*TrackSettings
+	Scoring ScoringSettings
+	Spam    SpamSettings
+	// AuditChannel receives the reward role changes, none if empty.
+	AuditChannel  string
+	Announcements AnnouncementSettings
+	Exclusions    ExclusionSettings
+
+	// RankRoles, RewardRoles, SeriesWeights and MetricChannels contain the single track of previous versions
+	// and are only read for migration.
+	RankRoles                     []*RankRoleSettings            `toml:",omitempty"`
+	RewardRoles                   map[string]*RewardRoleSettings `toml:",omitempty"`
+	SeriesWeights                 map[string]float64             `toml:",omitempty"`
+	MetricChannelFilterSerialized *SerializedChannelFilter       `toml:"MetricChannels,omitempty"`
+	// RewardRole contains the targets of previous versions which always used the median and is only read for migration.
+	RewardRole map[string]int64 `toml:",omitempty"`
+	// KingsRole contains the top 6 role of previous versions and is only read for migration.
+	KingsRole string `toml:",omitempty"`
+}
+
+// Settings contains the settings of all guilds. The guild settings are copy-on-write snapshots,
+// readers get them by guildSettings and writers replace them by updateGuildSettings.
+var Settings = struct {
+	mutex sync.RWMutex
+
+	// Version is the version of the settings format, see settingsMigrations.
+	Version int
+	Cron    CronSettings
+
+	Guilds map[string]*GuildSettings
 }{
-	NumTrackedDays: 7,
-	metricChannelFilter: ChannelFilter{
-		IncludeCategories: mapset.NewSet[string](),
-		IncludeChannels:   mapset.NewSet[string](),
-		ExcludeChannels:   mapset.NewSet[string](),
-	},
-	KingsRole:  "",
-	RewardRole: map[string]int64{},
-	Cron: CronSettings{
-		SaveMetrics:    "*/5 * * * *",
-		UpdateRewards:  "*/5 * * * *",
-		CumulationStep: "*/5 * * * *",
-	},
-	MetricChannelFilterSerialized: nil,
+	Version: settingsVersion,
+	Cron:    defaultCronSettings(),
+	Guilds:  map[string]*GuildSettings{},
+}
+
+func defaultCronSettings() CronSettings {
+	return CronSettings{
+		SaveMetrics:      "*/5 * * * *",
+		UpdateRewards:    "*/5 * * * *",
+		CumulationStep:   "*/5 * * * *",
+		ReconcileMembers: "@hourly",
+	}
+}
+
+func newGuildSettings() *GuildSettings {
+	return &GuildSettings{
+		NumTrackedDays: 7,
+		Timezone:       "UTC",
+		timezone:       time.UTC,
+		Tracks: map[string]*TrackSettings{
+			DefaultTrack: newTrackSettings(),
+		},
+		Scoring:       defaultScoringSettings(),
+		Spam:          defaultSpamSettings(),
+		Announcements: defaultAnnouncementSettings(),
+		Exclusions:    defaultExclusionSettings(),
+	}
+}
+
+// track returns the settings of the track or empty settings if the track does not exist (anymore).
+func (s *GuildSettings) track(name string) *TrackSettings {
+	if track, ok := s.Tracks[name]; ok {
+		return track
+	}
+	return newTrackSettings()
+}
+
+// trackNames returns the names of all tracks sorted with the default track first.
+func (s *GuildSettings) trackNames() []string {
+	names := slices.Collect(maps.Keys(s.Tracks))
+	slices.SortFunc(names, func(a, b string) int {
+		switch {
+		case a == b:
+			return 0
+		case a == DefaultTrack:
+			return -1
+		case b == DefaultTrack:
+			return 1
+		}
+		return cmp.Compare(a, b)
+	})
+	return names
+}
+
+// location returns the timezone of the guild, it is resolved once by resolveLocation when the settings change.
+func (s *GuildSettings) location() *time.Location {
+	if s.timezone == nil {
+		return time.UTC
+	}
+	return s.timezone
+}
+
+// resolveLocation loads the location of Timezone, it falls back to UTC if the timezone is unknown.
+func (s *GuildSettings) resolveLocation() {
+	location, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	s.timezone = location
+}
+
+// guildSettings returns a snapshot of the settings of the given guild and creates default settings if the guild is not yet known.
+// The snapshot must not be modified, use updateGuildSettings instead.
+func guildSettings(guild string) *GuildSettings {
+	Settings.mutex.RLock()
+	settings, ok := Settings.Guilds[guild]
+	Settings.mutex.RUnlock()
+	if ok {
+		return settings
+	}
+
+	Settings.mutex.Lock()
+	defer Settings.mutex.Unlock()
+
+	settings, ok = Settings.Guilds[guild]
+	if !ok {
+		settings = newGuildSettings()
+		settings.serialize()
+		Settings.Guilds[guild] = settings
+	}
+	return settings
+}
+
+// updateGuildSettings applies the update to a copy of the settings of the guild, saves it and replaces the snapshot.
+// If the update or saving fails the settings stay unchanged. Updates must not access the settings themselves.
+func updateGuildSettings(guild string, update func(settings *GuildSettings) error) error {
+	Settings.mutex.Lock()
+	defer Settings.mutex.Unlock()
+
+	current, ok := Settings.Guilds[guild]
+	if !ok {
+		current = newGuildSettings()
+	}
+	settings := current.clone()
+	if err := update(settings); err != nil {
+		return err
+	}
+	settings.resolveLocation()
+	settings.serialize()
+
+	Settings.Guilds[guild] = settings
+	if err := writeSettings(); err != nil {
+		if ok {
+			Settings.Guilds[guild] = current
+		} else {
+			delete(Settings.Guilds, guild)
+		}
+		log.Printf("Failed to save settings of guild %s: %e", guild, err)
+		return err
+	}
+	return nil
+}
+
+// updateCronSettings applies the update to a copy of the schedules and saves it, see updateGuildSettings.
+// The scheduler has to be rescheduled by the caller.
+func updateCronSettings(update func(schedules *CronSettings) error) error {
+	Settings.mutex.Lock()
+	defer Settings.mutex.Unlock()
+
+	current := Settings.Cron
+	schedules := current
+	if err := update(&schedules); err != nil {
+		return err
+	}
+
+	Settings.Cron = schedules
+	if err := writeSettings(); err != nil {
+		Settings.Cron = current
+		log.Printf("Failed to save schedules: %e", err)
+		return err
+	}
+	return nil
+}
+
+// updateTrackSettings applies the update to the named track of the guild, see updateGuildSettings.
+func updateTrackSettings(guild string, name string, update func(track *TrackSettings) error) error {
+	return updateGuildSettings(guild, func(settings *GuildSettings) error {
+		track, ok := settings.Tracks[name]
+		if !ok {
+			return fmt.Errorf("unknown track %s", name)
+		}
+		return update(track)
+	})
+}
+
+// clone deep copies the settings, the channel caches are shared.
+func (s *GuildSettings) clone() *GuildSettings {
+	clone := *s
+	clone.Tracks = make(map[string]*TrackSettings, len(s.Tracks))
+	for name, track := range s.Tracks {
+		clone.Tracks[name] = track.clone()
+	}
+	clone.Scoring = s.Scoring.clone()
+	clone.Exclusions = s.Exclusions.clone()
+	return &clone
+}
+
+func (t *TrackSettings) clone() *TrackSettings {
+	clone := &TrackSettings{
+		metricChannelFilter: t.metricChannelFilter.clone(),
+		RankRoles:           make([]*RankRoleSettings, 0, len(t.RankRoles)),
+		RewardRoles:         make(map[string]*RewardRoleSettings, len(t.RewardRoles)),
+		SeriesWeights:       maps.Clone(t.SeriesWeights),
+	}
+	for _, rank := range t.RankRoles {
+		rankClone := *rank
+		clone.RankRoles = append(clone.RankRoles, &rankClone)
+	}
+	for role, reward := range t.RewardRoles {
+		rewardClone := *reward
+		clone.RewardRoles[role] = &rewardClone
+	}
+	return clone
+}
+
+// serialize updates the serialized channel filters of the tracks.
+func (s *GuildSettings) serialize() {
+	for _, track := range s.Tracks {
+		track.MetricChannelFilterSerialized = track.metricChannelFilter.ToSerialized()
+	}
 }
 
 func SeparatorSpacingSizePtr(s discordgo.SeparatorSpacingSize) *discordgo.SeparatorSpacingSize {
 	return &s
 }
 
-func createSettings(s *discordgo.Session) []discordgo.MessageComponent {
+func createSettings(s *discordgo.Session, guild string) []discordgo.MessageComponent {
+	settings := guildSettings(guild)
+
 	var msg strings.Builder
 	msg.WriteString("# Metrics\n")
+	msg.WriteString(fmt.Sprintf("**Timezone:** %s\n", settings.Timezone))
+	msg.WriteString(fmt.Sprintf("**Tracks:** %s\n", strings.Join(settings.trackNames(), ", ")))
+	msg.WriteString("# Scoring\n")
+	msg.WriteString(fmt.Sprintf("**Points by Length:** %s\n", formatLengthPoints(settings.Scoring.LengthPoints)))
+	msg.WriteString(fmt.Sprintf("**Attachment:** %d, **Reply:** %d, **Thread Starter:** %d\n", settings.Scoring.AttachmentPoints, settings.Scoring.ReplyPoints, settings.Scoring.ThreadStarterPoints))
+	msg.WriteString("**Channel Multipliers:**\n")
+	for c, multiplier := range settings.Scoring.ChannelMultipliers {
+		msg.WriteString(fmt.Sprintf("* <#%s> (x%g)\n", c, multiplier))
+	}
+	msg.WriteString("# Anti-Spam\n")
+	msg.WriteString(formatSpamSettings(settings.Spam) + "\n")
+	msg.WriteString(formatExclusionSettings(settings.Exclusions) + "\n")
+	msg.WriteString("# Rewards\n")
+	if settings.AuditChannel != "" {
+		msg.WriteString(fmt.Sprintf("**Audit Log:** <#%s>\n", settings.AuditChannel))
+	} else {
+		msg.WriteString("**Audit Log:** disabled\n")
+	}
+	msg.WriteString(formatAnnouncementSettings(settings.Announcements) + "\n")
+
+	var trackOptions []discordgo.SelectMenuOption
+	for _, name := range settings.trackNames() {
+		trackOptions = append(trackOptions, discordgo.SelectMenuOption{
+			Label: name,
+			Value: name,
+		})
+	}
+
+	return []discordgo.MessageComponent{
+		discordgo.TextDisplay{
+			Content: msg.String(),
+		},
+		discordgo.Separator{
+			Spacing: SeparatorSpacingSizePtr(discordgo.SeparatorSpacingSizeLarge),
+		},
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Change Timezone",
+					Style:    discordgo.SecondaryButton,
+					CustomID: "change_timezone",
+				},
+				discordgo.Button{
+					Label:    "Add Track",
+					Style:    discordgo.SecondaryButton,
+					CustomID: "add_track",
+				},
+			},
+		},
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					MenuType:    discordgo.StringSelectMenu,
+					Placeholder: "Edit Track",
+					Options:     trackOptions,
+					CustomID:    "edit_track",
+				},
+			},
+		},
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Edit Scoring",
+					Style:    discordgo.SecondaryButton,
+					CustomID: "edit_scoring",
+				},
+				discordgo.Button{
+					Label:    "Edit Anti-Spam",
+					Style:    discordgo.SecondaryButton,
+					CustomID: "edit_spam",
+				},
+				discordgo.Button{
+					Label:    "Edit Announcements",
+					Style:    discordgo.SecondaryButton,
+					CustomID: "edit_announcements",
+				},
+				discordgo.Button{
+					Label:    "Toggle Ignore Bots",
+					Style:    discordgo.SecondaryButton,
+					CustomID: "toggle_ignore_bots",
+				},
+			},
+		},
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					MenuType:    discordgo.MentionableSelectMenu,
+					Placeholder: "Toggle Excluded User/Role",
+					CustomID:    "toggle_exclusion",
+				},
+			},
+		},
+		discordgo.TextDisplay{
+			Content: "Set Channel Multiplier:",
+		},
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					MenuType: discordgo.ChannelSelectMenu,
+					ChannelTypes: []discordgo.ChannelType{
+						discordgo.ChannelTypeGuildText,
+					},
+					CustomID: "set_channel_multiplier",
+				},
+			},
+		},
+		discordgo.TextDisplay{
+			Content: "Toggle Audit Log Channel:",
+		},
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					MenuType: discordgo.ChannelSelectMenu,
+					ChannelTypes: []discordgo.ChannelType{
+						discordgo.ChannelTypeGuildText,
+					},
+					CustomID: "toggle_audit_channel",
+				},
+			},
+		},
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					MenuType: discordgo.ChannelSelectMenu,
+					ChannelTypes: []discordgo.ChannelType{
+						discordgo.ChannelTypeGuildText,
+						discordgo.ChannelTypeGuildNews,
+					},
+					Placeholder: "Set Announcement Channel",
+					CustomID:    "set_announcement_channel",
+				},
+			},
+		},
+	}
+}
+
+// createTrackSettings builds the panel editing the channels, sources and reward roles of a track.
+func createTrackSettings(s *discordgo.Session, guild string, name string) []discordgo.MessageComponent {
+	track := guildSettings(guild).track(name)
+
+	var msg strings.Builder
+	msg.WriteString(fmt.Sprintf("# Track %s\n", name))
 	msg.WriteString("**Included Categories:**\n")
-	for c := range Settings.metricChannelFilter.IncludeCategories.Iter() {
+	for c := range track.metricChannelFilter.IncludeCategories.Iter() {
 		msg.WriteString(fmt.Sprintf("* <#%s>\n", c))
 	}
 	msg.WriteString("**Included Channels:**\n")
-	for c := range Settings.metricChannelFilter.IncludeChannels.Iter() {
+	for c := range track.metricChannelFilter.IncludeChannels.Iter() {
 		msg.WriteString(fmt.Sprintf("* <#%s>\n", c))
 	}
 	msg.WriteString("**Excluded Channels:**\n")
-	for c := range Settings.metricChannelFilter.ExcludeChannels.Iter() {
+	for c := range track.metricChannelFilter.ExcludeChannels.Iter() {
 		msg.WriteString(fmt.Sprintf("* <#%s>\n", c))
 	}
+	if track.metricChannelFilter.IncludePatterns.Cardinality() > 0 {
+		msg.WriteString(fmt.Sprintf("**Included Names:** %s\n", formatPatterns(track.metricChannelFilter.IncludePatterns)))
+	}
+	if track.metricChannelFilter.ExcludePatterns.Cardinality() > 0 {
+		msg.WriteString(fmt.Sprintf("**Excluded Names:** %s\n", formatPatterns(track.metricChannelFilter.ExcludePatterns)))
+	}
+	msg.WriteString(fmt.Sprintf("**Sources:** %s\n", formatSeriesWeights(track.SeriesWeights)))
 	msg.WriteString("# Rewards\n")
-	msg.WriteString(fmt.Sprintf("Top 6: <@&%s>\n", Settings.KingsRole))
-	for role, target := range Settings.RewardRole {
-		msg.WriteString(fmt.Sprintf("* <@&%s> (%d)\n", role, target))
+	for _, rank := range track.RankRoles {
+		if rank.From == rank.To {
+			msg.WriteString(fmt.Sprintf("* #%d: <@&%s>", rank.From, rank.Role))
+		} else {
+			msg.WriteString(fmt.Sprintf("* #%d - #%d: <@&%s>", rank.From, rank.To, rank.Role))
+		}
+		if rank.keepTo() != rank.To {
+			msg.WriteString(fmt.Sprintf(", kept up to #%d", rank.keepTo()))
+		}
+		if rank.GraceHours > 0 {
+			msg.WriteString(fmt.Sprintf(", %dh grace", rank.GraceHours))
+		}
+		msg.WriteString("\n")
 	}
-
-	kingsDefault := []discordgo.SelectMenuDefaultValue{}
-	if Settings.KingsRole != "" {
-		kingsDefault = []discordgo.SelectMenuDefaultValue{{
-			Type: discordgo.SelectMenuDefaultValueRole,
-			ID:   Settings.KingsRole,
-		}}
+	for role, reward := range track.RewardRoles {
+		msg.WriteString(fmt.Sprintf("* <@&%s> (%s >= %d", role, reward.Aggregation, reward.Target))
+		if reward.keepTarget() != reward.Target {
+			msg.WriteString(fmt.Sprintf(", kept >= %d", reward.keepTarget()))
+		}
+		if reward.GraceHours > 0 {
+			msg.WriteString(fmt.Sprintf(", %dh grace", reward.GraceHours))
+		}
+		msg.WriteString(")\n")
 	}
 
 	return []discordgo.MessageComponent{
@@ -85,6 +519,31 @@ func createSettings(s *discordgo.Session) []discordgo.MessageComponent {
 		discordgo.Separator{
 			Spacing: SeparatorSpacingSizePtr(discordgo.SeparatorSpacingSizeLarge),
 		},
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Back",
+					Style:    discordgo.SecondaryButton,
+					CustomID: "show_settings",
+				},
+				discordgo.Button{
+					Label:    "Edit Name Patterns",
+					Style:    discordgo.SecondaryButton,
+					CustomID: fmt.Sprintf("edit_channel_patterns|%s", name),
+				},
+				discordgo.Button{
+					Label:    "Edit Sources",
+					Style:    discordgo.SecondaryButton,
+					CustomID: fmt.Sprintf("edit_sources|%s", name),
+				},
+				discordgo.Button{
+					Label:    "Remove Track",
+					Style:    discordgo.DangerButton,
+					Disabled: name == DefaultTrack,
+					CustomID: fmt.Sprintf("remove_track|%s", name),
+				},
+			},
+		},
 		discordgo.TextDisplay{
 			Content: "Toggle Include Channel/Category:",
 		},
@@ -95,8 +554,12 @@ func createSettings(s *discordgo.Session) []discordgo.MessageComponent {
 					ChannelTypes: []discordgo.ChannelType{
 						discordgo.ChannelTypeGuildCategory,
 						discordgo.ChannelTypeGuildText,
+						discordgo.ChannelTypeGuildNews,
+						discordgo.ChannelTypeGuildForum,
+						discordgo.ChannelTypeGuildVoice,
+						discordgo.ChannelTypeGuildStageVoice,
 					},
-					CustomID: "toggle_include",
+					CustomID: fmt.Sprintf("toggle_include|%s", name),
 				},
 			},
 		},
@@ -108,21 +571,39 @@ func createSettings(s *discordgo.Session) []discordgo.MessageComponent {
 				discordgo.SelectMenu{
 					MenuType: discordgo.ChannelSelectMenu,
 					ChannelTypes: []discordgo.ChannelType{
+						discordgo.ChannelTypeGuildCategory,
 						discordgo.ChannelTypeGuildText,
+						discordgo.ChannelTypeGuildNews,
+						discordgo.ChannelTypeGuildForum,
+						discordgo.ChannelTypeGuildVoice,
+						discordgo.ChannelTypeGuildStageVoice,
+						discordgo.ChannelTypeGuildPublicThread,
+						discordgo.ChannelTypeGuildPrivateThread,
+						discordgo.ChannelTypeGuildNewsThread,
 					},
-					CustomID: "toggle_exclude",
+					CustomID: fmt.Sprintf("toggle_exclude|%s", name),
+				},
+			},
+		},
+		discordgo.TextDisplay{
+			Content: "Add Ranking Role:",
+		},
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.SelectMenu{
+					MenuType: discordgo.RoleSelectMenu,
+					CustomID: fmt.Sprintf("add_rank_role|%s", name),
 				},
 			},
 		},
 		discordgo.TextDisplay{
-			Content: "Change Top 5 Role:",
+			Content: "Remove Ranking Role:",
 		},
 		discordgo.ActionsRow{
 			Components: []discordgo.MessageComponent{
 				discordgo.SelectMenu{
-					MenuType:      discordgo.RoleSelectMenu,
-					DefaultValues: kingsDefault,
-					CustomID:      "change_kings_role",
+					MenuType: discordgo.RoleSelectMenu,
+					CustomID: fmt.Sprintf("remove_rank_role|%s", name),
 				},
 			},
 		},
@@ -133,7 +614,7 @@ func createSettings(s *discordgo.Session) []discordgo.MessageComponent {
 			Components: []discordgo.MessageComponent{
 				discordgo.SelectMenu{
 					MenuType: discordgo.RoleSelectMenu,
-					CustomID: "add_reward",
+					CustomID: fmt.Sprintf("add_reward|%s", name),
 				},
 			},
 		},
@@ -144,58 +625,88 @@ func createSettings(s *discordgo.Session) []discordgo.MessageComponent {
 			Components: []discordgo.MessageComponent{
 				discordgo.SelectMenu{
 					MenuType: discordgo.RoleSelectMenu,
-					CustomID: "remove_reward",
+					CustomID: fmt.Sprintf("remove_reward|%s", name),
 				},
 			},
 		},
 	}
 }
 
+const settingsKey = "settings.toml"
+
 func saveSettings() {
-	Settings.MetricChannelFilterSerialized = Settings.metricChannelFilter.ToSerialized()
+	Settings.mutex.Lock()
+	defer Settings.mutex.Unlock()
 
-	log.Println("Saving settings...")
-	b, err := toml.Marshal(&Settings)
-	if err != nil {
-		log.Panicln(err)
+	if err := writeSettings(); err != nil {
+		log.Panicf("unable to save settings: %e", err)
 	}
+}
+
+// writeSettings saves the settings of all guilds, the caller has to hold the mutex.
+// writeSettings saves the current settings, the caller has to hold the mutex.
+func writeSettings() error {
+	return writeSettingsData(&settingsData{
+		Version: Settings.Version,
+		Cron:    Settings.Cron,
+		Guilds:  Settings.Guilds,
+	})
+}
 
-	err = os.WriteFile("settings.toml", b, 0644)
+// writeSettingsData saves the given settings, e.g. before they replace the current ones.
+func writeSettingsData(data *settingsData) error {
+	log.Println("Saving settings...")
+	b, err := toml.Marshal(data)
 	if err != nil {
-		log.Panicf("unable to save settings: %e", err)
+		return err
 	}
 
-	Settings.MetricChannelFilterSerialized = nil
+	if err = store.Save(settingsKey, b); err != nil {
+		return err
+	}
 
 	log.Println("Settings saved.")
+	return nil
 }
 
 func loadSettings() {
 	log.Println("Loading settings...")
-	if _, err := os.Stat("settings.toml"); err == nil {
-		b, err := os.ReadFile("settings.toml")
-		if err != nil {
-			log.Panicf("unable to load settings: %e", err)
-		}
-
-		err = toml.Unmarshal(b, &Settings)
+	b, err := store.Load(settingsKey)
+	if err != nil && err != ErrNotStored {
+		log.Panicf("unable to load settings: %e", err)
+	}
+	if err == nil {
+		data, migrated, err := parseSettings(b)
 		if err != nil {
 			log.Panicln(err)
 		}
-
-		Settings.metricChannelFilter = Settings.MetricChannelFilterSerialized.ToUnserialized()
-		Settings.MetricChannelFilterSerialized = nil
+		if err = validateSettings(data); err != nil {
+			log.Panicf("invalid settings:\n%v", err)
+		}
+		Settings.Version = data.Version
+		Settings.Cron = data.Cron
+		Settings.Guilds = data.Guilds
 
 		log.Println("Settings loaded.")
+
+		if migrated {
+			saveSettings()
+		}
 	} else {
-		log.Println("No settings file found. Load and save default settings.")
+		log.Println("No settings stored. Load and save default settings.")
 		saveSettings()
 	}
 }
 
-func init() {
-	loadSettings()
+// cronSettings returns the schedules of the jobs.
+func cronSettings() CronSettings {
+	Settings.mutex.RLock()
+	defer Settings.mutex.RUnlock()
 
+	return Settings.Cron
+}
+
+func init() {
 	maps.Copy(commands, map[*discordgo.ApplicationCommand]func(s *discordgo.Session, i *discordgo.InteractionCreate){
 		{
 			Name:                     "alice_settings",
@@ -206,75 +717,164 @@ func init() {
 			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 				Type: discordgo.InteractionResponseChannelMessageWithSource,
 				Data: &discordgo.InteractionResponseData{
-					Components:      createSettings(s),
+					Components:      createSettings(s, i.GuildID),
 					AllowedMentions: &discordgo.MessageAllowedMentions{},
 					Flags:           discordgo.MessageFlagsIsComponentsV2 | discordgo.MessageFlagsEphemeral,
 				},
 			})
 			if err != nil {
 				log.Println(err)
+				return
 			}
+			rememberSettingsPanel(i, "")
 		},
 	})
 
 	maps.Copy(messageComponents, map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){
 		"toggle_include": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			name, _, ok := customIDTrack(strings.Split(i.MessageComponentData().CustomID, "|"), 0)
+			if !ok {
+				return
+			}
+
+			var channels []*discordgo.Channel
 			for _, c := range i.MessageComponentData().Values {
 				channel, err := s.Channel(c)
 				if err != nil {
 					continue
 				}
-				switch channel.Type {
-				case discordgo.ChannelTypeGuildCategory:
-					if Settings.metricChannelFilter.IncludeCategories.Contains(channel.ID) {
-						Settings.metricChannelFilter.IncludeCategories.Remove(channel.ID)
-					} else {
-						Settings.metricChannelFilter.IncludeCategories.Add(channel.ID)
-					}
-				case discordgo.ChannelTypeGuildText:
-					if Settings.metricChannelFilter.IncludeChannels.Contains(channel.ID) {
-						Settings.metricChannelFilter.IncludeChannels.Remove(channel.ID)
-					} else {
-						Settings.metricChannelFilter.IncludeChannels.Add(channel.ID)
+				channels = append(channels, channel)
+			}
+
+			err := updateTrackSettings(i.GuildID, name, func(track *TrackSettings) error {
+				for _, channel := range channels {
+					switch channel.Type {
+					case discordgo.ChannelTypeGuildCategory:
+						if track.metricChannelFilter.IncludeCategories.Contains(channel.ID) {
+							track.metricChannelFilter.IncludeCategories.Remove(channel.ID)
+						} else {
+							track.metricChannelFilter.IncludeCategories.Add(channel.ID)
+						}
+					default:
+						if track.metricChannelFilter.IncludeChannels.Contains(channel.ID) {
+							track.metricChannelFilter.IncludeChannels.Remove(channel.ID)
+						} else {
+							track.metricChannelFilter.IncludeChannels.Add(channel.ID)
+						}
 					}
 				}
+				return nil
+			})
+			if err != nil {
+				return
 			}
 
-			saveSettings()
-
-			updateSettingsMessage(s, i)
+			updateTrackMessage(s, i, name)
 
-			updateAllowedChannels(s)
+			updateAllowedChannels(s, i.GuildID)
 		},
 		"toggle_exclude": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
-			for _, c := range i.MessageComponentData().Values {
-				channel, err := s.Channel(c)
-				if err != nil {
-					continue
-				}
-				switch channel.Type {
-				case discordgo.ChannelTypeGuildText:
-					if Settings.metricChannelFilter.ExcludeChannels.Contains(channel.ID) {
-						Settings.metricChannelFilter.ExcludeChannels.Remove(channel.ID)
+			name, _, ok := customIDTrack(strings.Split(i.MessageComponentData().CustomID, "|"), 0)
+			if !ok {
+				return
+			}
+
+			err := updateTrackSettings(i.GuildID, name, func(track *TrackSettings) error {
+				for _, c := range i.MessageComponentData().Values {
+					if track.metricChannelFilter.ExcludeChannels.Contains(c) {
+						track.metricChannelFilter.ExcludeChannels.Remove(c)
 					} else {
-						Settings.metricChannelFilter.ExcludeChannels.Add(channel.ID)
+						track.metricChannelFilter.ExcludeChannels.Add(c)
 					}
 				}
+				return nil
+			})
+			if err != nil {
+				return
 			}
 
-			saveSettings()
+			updateTrackMessage(s, i, name)
 
-			updateSettingsMessage(s, i)
+			updateAllowedChannels(s, i.GuildID)
+		},
+		"add_rank_role": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			name, _, ok := customIDTrack(strings.Split(i.MessageComponentData().CustomID, "|"), 0)
+			if !ok {
+				return
+			}
 
-			updateAllowedChannels(s)
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseModal,
+				Data: &discordgo.InteractionResponseData{
+					Title: "Add Ranking Role",
+					Components: []discordgo.MessageComponent{
+						discordgo.ActionsRow{
+							Components: []discordgo.MessageComponent{
+								discordgo.TextInput{
+									Label:       "From Rank",
+									Placeholder: "Highest rank getting the role, starting with 1",
+									Style:       discordgo.TextInputShort,
+									Required:    true,
+									CustomID:    "rank_from",
+								},
+							},
+						},
+						discordgo.ActionsRow{
+							Components: []discordgo.MessageComponent{
+								discordgo.TextInput{
+									Label:       "To Rank",
+									Placeholder: "Lowest rank getting the role",
+									Style:       discordgo.TextInputShort,
+									Required:    true,
+									CustomID:    "rank_to",
+								},
+							},
+						},
+						discordgo.ActionsRow{
+							Components: []discordgo.MessageComponent{
+								discordgo.TextInput{
+									Label:       "Keep up to Rank",
+									Placeholder: "Lowest rank keeping the role, defaults to To Rank",
+									Style:       discordgo.TextInputShort,
+									Required:    false,
+									CustomID:    "rank_keep_to",
+								},
+							},
+						},
+						graceTextInput(),
+					},
+					CustomID: fmt.Sprintf("add_rank_role|%s|%s", name, i.MessageComponentData().Values[0]),
+				},
+			})
+			if err != nil {
+				log.Println(err)
+			}
 		},
-		"change_kings_role": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
-			Settings.KingsRole = i.MessageComponentData().Values[0]
-			saveSettings()
+		"remove_rank_role": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			name, _, ok := customIDTrack(strings.Split(i.MessageComponentData().CustomID, "|"), 0)
+			if !ok {
+				return
+			}
 
-			updateSettingsMessage(s, i)
+			role := i.MessageComponentData().Values[0]
+			err := updateTrackSettings(i.GuildID, name, func(track *TrackSettings) error {
+				track.RankRoles = slices.DeleteFunc(track.RankRoles, func(rank *RankRoleSettings) bool {
+					return rank.Role == role
+				})
+				return nil
+			})
+			if err != nil {
+				return
+			}
+
+			updateTrackMessage(s, i, name)
 		},
 		"add_reward": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			name, _, ok := customIDTrack(strings.Split(i.MessageComponentData().CustomID, "|"), 0)
+			if !ok {
+				return
+			}
+
 			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 				Type: discordgo.InteractionResponseModal,
 				Data: &discordgo.InteractionResponseData{
@@ -291,8 +891,32 @@ func init() {
 								},
 							},
 						},
+						discordgo.ActionsRow{
+							Components: []discordgo.MessageComponent{
+								discordgo.TextInput{
+									Label:       "Keep Target",
+									Placeholder: "Score to stay above to keep the role, defaults to Target",
+									Style:       discordgo.TextInputShort,
+									Required:    false,
+									CustomID:    "reward_keep_target",
+								},
+							},
+						},
+						graceTextInput(),
+						discordgo.ActionsRow{
+							Components: []discordgo.MessageComponent{
+								discordgo.TextInput{
+									Label:       "Aggregation",
+									Placeholder: "median, mean, sum, percentile 90, ewma 0.3 or active_days",
+									Value:       AggregationMedian,
+									Style:       discordgo.TextInputShort,
+									Required:    false,
+									CustomID:    "reward_aggregation",
+								},
+							},
+						},
 					},
-					CustomID: fmt.Sprintf("add_reward|%s", i.MessageComponentData().Values[0]),
+					CustomID: fmt.Sprintf("add_reward|%s|%s", name, i.MessageComponentData().Values[0]),
 					Flags:    discordgo.MessageFlagsIsComponentsV2,
 				},
 			})
@@ -300,31 +924,254 @@ func init() {
 				log.Println(err)
 			}
 		},
+		"change_timezone": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			settings := guildSettings(i.GuildID)
+
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseModal,
+				Data: &discordgo.InteractionResponseData{
+					Title: "Change Timezone",
+					Components: []discordgo.MessageComponent{
+						discordgo.ActionsRow{
+							Components: []discordgo.MessageComponent{
+								discordgo.TextInput{
+									Label:       "Timezone",
+									Placeholder: "IANA timezone like Europe/Berlin",
+									Value:       settings.Timezone,
+									Style:       discordgo.TextInputShort,
+									Required:    true,
+									CustomID:    "timezone",
+								},
+							},
+						},
+					},
+					CustomID: "change_timezone",
+				},
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		},
+		"edit_channel_patterns": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			name, _, ok := customIDTrack(strings.Split(i.MessageComponentData().CustomID, "|"), 0)
+			if !ok {
+				return
+			}
+			filter := guildSettings(i.GuildID).track(name).metricChannelFilter
+
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseModal,
+				Data: &discordgo.InteractionResponseData{
+					Title: "Edit Name Patterns",
+					Components: []discordgo.MessageComponent{
+						discordgo.ActionsRow{
+							Components: []discordgo.MessageComponent{
+								discordgo.TextInput{
+									Label:       "Include Channels Named",
+									Placeholder: "Comma separated globs like general-*, *-chat",
+									Value:       formatPatterns(filter.IncludePatterns),
+									Style:       discordgo.TextInputParagraph,
+									Required:    false,
+									CustomID:    "include_patterns",
+								},
+							},
+						},
+						discordgo.ActionsRow{
+							Components: []discordgo.MessageComponent{
+								discordgo.TextInput{
+									Label:       "Exclude Channels Named",
+									Placeholder: "Comma separated globs like bot-*, *-log",
+									Value:       formatPatterns(filter.ExcludePatterns),
+									Style:       discordgo.TextInputParagraph,
+									Required:    false,
+									CustomID:    "exclude_patterns",
+								},
+							},
+						},
+					},
+					CustomID: fmt.Sprintf("edit_channel_patterns|%s", name),
+				},
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		},
 		"remove_reward": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
-			delete(Settings.RewardRole, i.MessageComponentData().Values[0])
-			saveSettings()
+			name, _, ok := customIDTrack(strings.Split(i.MessageComponentData().CustomID, "|"), 0)
+			if !ok {
+				return
+			}
 
-			updateSettingsMessage(s, i)
+			err := updateTrackSettings(i.GuildID, name, func(track *TrackSettings) error {
+				delete(track.RewardRoles, i.MessageComponentData().Values[0])
+				return nil
+			})
+			if err != nil {
+				return
+			}
+
+			updateTrackMessage(s, i, name)
 		},
 	})
 
 	maps.Copy(modals, map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, ids []string){
+		"change_timezone": func(s *discordgo.Session, i *discordgo.InteractionCreate, ids []string) {
+			var timezone = i.ModalSubmitData().Components[0].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value
+			if _, err := time.LoadLocation(timezone); err != nil {
+				return
+			}
+
+			err := updateGuildSettings(i.GuildID, func(settings *GuildSettings) error {
+				settings.Timezone = timezone
+				return nil
+			})
+			if err != nil {
+				return
+			}
+
+			updateSettingsMessage(s, i)
+		},
+		"edit_channel_patterns": func(s *discordgo.Session, i *discordgo.InteractionCreate, ids []string) {
+			name, _, ok := customIDTrack(ids, 0)
+			if !ok {
+				return
+			}
+
+			includePatterns := parsePatterns(i.ModalSubmitData().Components[0].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value)
+			excludePatterns := parsePatterns(i.ModalSubmitData().Components[1].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value)
+
+			err := updateTrackSettings(i.GuildID, name, func(track *TrackSettings) error {
+				track.metricChannelFilter.IncludePatterns = includePatterns
+				track.metricChannelFilter.ExcludePatterns = excludePatterns
+				return nil
+			})
+			if err != nil {
+				return
+			}
+
+			updateTrackMessage(s, i, name)
+
+			updateAllowedChannels(s, i.GuildID)
+		},
+		"add_rank_role": func(s *discordgo.Session, i *discordgo.InteractionCreate, ids []string) {
+			name, args, ok := customIDTrack(ids, 1)
+			if !ok {
+				return
+			}
+
+			var fromStr = i.ModalSubmitData().Components[0].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value
+			from, err := strconv.Atoi(fromStr)
+			if err != nil || from < 1 {
+				return
+			}
+			var toStr = i.ModalSubmitData().Components[1].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value
+			to, err := strconv.Atoi(toStr)
+			if err != nil || to < from {
+				return
+			}
+			var keepToStr = i.ModalSubmitData().Components[2].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value
+			keepTo, err := parseOptionalInt(keepToStr)
+			if err != nil || (keepTo != 0 && keepTo < to) {
+				return
+			}
+			var graceStr = i.ModalSubmitData().Components[3].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value
+			grace, err := parseOptionalInt(graceStr)
+			if err != nil || grace < 0 {
+				return
+			}
+
+			err = updateTrackSettings(i.GuildID, name, func(track *TrackSettings) error {
+				track.RankRoles = slices.DeleteFunc(track.RankRoles, func(rank *RankRoleSettings) bool {
+					return rank.Role == args[0]
+				})
+				track.RankRoles = append(track.RankRoles, &RankRoleSettings{
+					Role:       args[0],
+					From:       from,
+					To:         to,
+					KeepTo:     keepTo,
+					GraceHours: grace,
+				})
+				slices.SortFunc(track.RankRoles, func(a, b *RankRoleSettings) int {
+					return cmp.Compare(a.From, b.From)
+				})
+				return nil
+			})
+			if err != nil {
+				return
+			}
+
+			updateTrackMessage(s, i, name)
+		},
 		"add_reward": func(s *discordgo.Session, i *discordgo.InteractionCreate, ids []string) {
+			name, args, ok := customIDTrack(ids, 1)
+			if !ok {
+				return
+			}
+
 			var targetStr = i.ModalSubmitData().Components[0].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value
 			target, err := strconv.ParseInt(targetStr, 10, 64)
 			if err != nil {
 				return
 			}
+			var keepTargetStr = i.ModalSubmitData().Components[1].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value
+			keepTarget, err := parseOptionalInt(keepTargetStr)
+			if err != nil || keepTarget > int(target) {
+				return
+			}
+			var graceStr = i.ModalSubmitData().Components[2].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value
+			grace, err := parseOptionalInt(graceStr)
+			if err != nil || grace < 0 {
+				return
+			}
+			var aggregationStr = i.ModalSubmitData().Components[3].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value
+			aggregation, err := parseAggregation(aggregationStr)
+			if err != nil {
+				return
+			}
 
-			Settings.RewardRole[ids[1]] = target
+			err = updateTrackSettings(i.GuildID, name, func(track *TrackSettings) error {
+				track.RewardRoles[args[0]] = &RewardRoleSettings{
+					Target:      target,
+					KeepTarget:  int64(keepTarget),
+					GraceHours:  grace,
+					Aggregation: aggregation,
+				}
+				return nil
+			})
+			if err != nil {
+				return
+			}
 
-			updateSettingsMessage(s, i)
+			updateTrackMessage(s, i, name)
 		},
 	})
 }
 
+func graceTextInput() discordgo.ActionsRow {
+	return discordgo.ActionsRow{
+		Components: []discordgo.MessageComponent{
+			discordgo.TextInput{
+				Label:       "Grace Period in Hours",
+				Placeholder: "Time below the keep threshold before the role is removed",
+				Style:       discordgo.TextInputShort,
+				Required:    false,
+				CustomID:    "grace_hours",
+			},
+		},
+	}
+}
+
+// parseOptionalInt parses an optional modal input, an empty input is 0.
+func parseOptionalInt(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
 func updateSettingsMessage(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	msg := createSettings(s)
+	msg := createSettings(s, i.GuildID)
 	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseUpdateMessage,
 		Data: &discordgo.InteractionResponseData{
@@ -335,5 +1182,7 @@ func updateSettingsMessage(s *discordgo.Session, i *discordgo.InteractionCreate)
 	})
 	if err != nil {
 		log.Println(err)
+		return
 	}
+	rememberSettingsPanel(i, "")
 }
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+// settingsVersion is the version of the settings format written by this version of the bot.
+// Settings without a version were written before versioning and have version 0.
+const settingsVersion = 3
+
+// settingsMigrations migrate the settings of the version of their index to the next version.
+var settingsMigrations = []func(tree *toml.Tree, data *settingsData) error{
+	migrateSingleGuild,
+	migrateTracks,
+	migrateLegacyRoles,
+}
+
+// settingsData is the content of settings.toml.
+type settingsData struct {
+	Version int
+	Cron    CronSettings
+	Guilds  map[string]*GuildSettings
+}
+
+// parseSettings parses the stored settings, migrates them to the current version and fills in missing values.
+// The returned flag tells whether anything was migrated and the settings should be saved again.
+func parseSettings(b []byte) (*settingsData, bool, error) {
+	tree, err := toml.LoadBytes(b)
+	if err != nil {
+		return nil, false, err
+	}
+
+	data := &settingsData{Cron: defaultCronSettings()}
+	if err = tree.Unmarshal(data); err != nil {
+		return nil, false, err
+	}
+	if data.Guilds == nil {
+		data.Guilds = map[string]*GuildSettings{}
+	}
+
+	if data.Version > settingsVersion {
+		return nil, false, fmt.Errorf("settings.toml has version %d, this version of the bot only supports up to version %d", data.Version, settingsVersion)
+	}
+	migrated := data.Version < settingsVersion
+	for ; data.Version < settingsVersion; data.Version++ {
+		if err = settingsMigrations[data.Version](tree, data); err != nil {
+			return nil, false, fmt.Errorf("failed to migrate settings from version %d: %w", data.Version, err)
+		}
+		log.Printf("Migrated settings from version %d to %d.", data.Version, data.Version+1)
+	}
+
+	for guild, settings := range data.Guilds {
+		normalizeGuildSettings(tree, guild, settings)
+	}
+
+	return data, migrated, nil
+}
+
+// migrateSingleGuild moves the settings of single guild installations from the top level to the guild.
+func migrateSingleGuild(tree *toml.Tree, data *settingsData) error {
+	if !tree.Has("NumTrackedDays") {
+		return nil
+	}
+	if legacyGuild == "" {
+		return errors.New("settings.toml contains single guild settings, use -g to specify the guild they belong to")
+	}
+
+	settings := newGuildSettings()
+	settings.Tracks = nil
+	if err := tree.Unmarshal(settings); err != nil {
+		return err
+	}
+	data.Guilds[legacyGuild] = settings
+	log.Printf("Migrated single guild settings to guild %s.", legacyGuild)
+	return nil
+}
+
+// migrateTracks moves the single track of the guild into the default track.
+func migrateTracks(_ *toml.Tree, data *settingsData) error {
+	for _, settings := range data.Guilds {
+		if settings.Tracks != nil {
+			continue
+		}
+		settings.Tracks = map[string]*TrackSettings{
+			DefaultTrack: {
+				RankRoles:                     settings.RankRoles,
+				RewardRoles:                   settings.RewardRoles,
+				SeriesWeights:                 settings.SeriesWeights,
+				MetricChannelFilterSerialized: settings.MetricChannelFilterSerialized,
+			},
+		}
+		settings.RankRoles = nil
+		settings.RewardRoles = nil
+		settings.SeriesWeights = nil
+		settings.MetricChannelFilterSerialized = nil
+	}
+	return nil
+}
+
+// migrateLegacyRoles turns the median targets and the top 6 role into reward and ranking roles of the default track.
+func migrateLegacyRoles(_ *toml.Tree, data *settingsData) error {
+	for _, settings := range data.Guilds {
+		defaultTrack, ok := settings.Tracks[DefaultTrack]
+		if !ok {
+			defaultTrack = newTrackSettings()
+			settings.Tracks[DefaultTrack] = defaultTrack
+		}
+		for role, target := range settings.RewardRole {
+			if defaultTrack.RewardRoles == nil {
+				defaultTrack.RewardRoles = map[string]*RewardRoleSettings{}
+			}
+			defaultTrack.RewardRoles[role] = &RewardRoleSettings{
+				Target:      target,
+				Aggregation: Aggregation{Function: AggregationMedian},
+			}
+		}
+		settings.RewardRole = nil
+		if settings.KingsRole != "" {
+			defaultTrack.RankRoles = append(defaultTrack.RankRoles, &RankRoleSettings{
+				Role: settings.KingsRole,
+				From: 1,
+				To:   6,
+			})
+			settings.KingsRole = ""
+		}
+	}
+	return nil
+}
+
+// normalizeGuildSettings fills in the values missing in the settings, e.g. of settings added after they were saved.
+func normalizeGuildSettings(tree *toml.Tree, guild string, settings *GuildSettings) {
+	if settings.Tracks == nil {
+		settings.Tracks = map[string]*TrackSettings{}
+	}
+	if _, ok := settings.Tracks[DefaultTrack]; !ok {
+		settings.Tracks[DefaultTrack] = newTrackSettings()
+	}
+	for _, track := range settings.Tracks {
+		track.metricChannelFilter = track.MetricChannelFilterSerialized.ToUnserialized()
+		if track.RankRoles == nil {
+			track.RankRoles = []*RankRoleSettings{}
+		}
+		if track.RewardRoles == nil {
+			track.RewardRoles = map[string]*RewardRoleSettings{}
+		}
+		if track.SeriesWeights == nil {
+			track.SeriesWeights = defaultSeriesWeights()
+		}
+	}
+	if settings.Timezone == "" {
+		settings.Timezone = "UTC"
+	}
+	if settings.Scoring.LengthPoints == nil {
+		settings.Scoring.LengthPoints = defaultScoringSettings().LengthPoints
+	}
+	if settings.Scoring.ChannelMultipliers == nil {
+		settings.Scoring.ChannelMultipliers = map[string]float64{}
+	}
+	if settings.Spam.Burst < 1 {
+		settings.Spam.Burst = 1
+	}
+	if settings.Announcements.Delivery == "" {
+		settings.Announcements = defaultAnnouncementSettings()
+	}
+	if !tree.Has(fmt.Sprintf("Guilds.%s.Exclusions", guild)) {
+		// bots were counted before the exclusions existed, only new guilds ignore them by default
+		settings.Exclusions = ExclusionSettings{}
+	}
+	if settings.Exclusions.Users == nil {
+		settings.Exclusions.Users = []string{}
+	}
+	if settings.Exclusions.Roles == nil {
+		settings.Exclusions.Roles = []string{}
+	}
+	settings.resolveLocation()
+	settings.serialize()
+}
+
+// SettingsError lists all problems found in the settings.
+type SettingsError struct {
+	Problems []string
+}
+
+func (e *SettingsError) Error() string {
+	return fmt.Sprintf("%d problem(s) in settings.toml:\n- %s", len(e.Problems), strings.Join(e.Problems, "\n- "))
+}
+
+type settingsProblems []string
+
+func (p *settingsProblems) addf(format string, args ...any) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+func isSnowflake(id string) bool {
+	_, err := strconv.ParseUint(id, 10, 64)
+	return err == nil
+}
+
+// validateSettings checks the settings for values the bot cannot work with and returns a SettingsError with all problems.
+// Roles missing in guilds whose roles are cached are only logged as warnings, a role deleted in Discord must not
+// keep the settings from loading.
+func validateSettings(data *settingsData) error {
+	var problems settingsProblems
+
+	for _, job := range scheduler.jobs {
+		spec := *job.schedule(&data.Cron)
+		if _, err := parseSchedule(spec); err != nil {
+			problems.addf("Cron.%s %q is no valid cron expression (minutes hours day-of-month month day-of-week, optionally preceded by seconds, or a descriptor like @hourly): %s", job.Name, spec, err)
+		}
+	}
+
+	for _, guild := range slices.Sorted(maps.Keys(data.Guilds)) {
+		guildProblems, warnings := guildSettingsProblems(guild, data.Guilds[guild])
+		problems = append(problems, guildProblems...)
+		for _, warning := range warnings {
+			log.Printf("Settings warning: %s", warning)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &SettingsError{Problems: problems}
+	}
+	return nil
+}
+
+// guildSettingsProblems returns the problems of the settings of the guild and the warnings about roles which do not
+// exist (anymore).
+func guildSettingsProblems(guild string, settings *GuildSettings) ([]string, []string) {
+	var problems, warnings settingsProblems
+	key := fmt.Sprintf("Guilds.%s", guild)
+
+	if !isSnowflake(guild) {
+		problems.addf("%s: %q is no guild ID", key, guild)
+	}
+	if settings.NumTrackedDays < 1 {
+		problems.addf("%s.NumTrackedDays is %d, at least 1 day has to be tracked", key, settings.NumTrackedDays)
+	}
+	if _, err := time.LoadLocation(settings.Timezone); err != nil {
+		problems.addf("%s.Timezone %q is no IANA timezone like Europe/Berlin", key, settings.Timezone)
+	}
+
+	checkRole := func(key string, role string) {
+		switch {
+		case !isSnowflake(role):
+			problems.addf("%s: %q is no role ID", key, role)
+		case rolesCached(guild) && cachedRole(guild, role) == nil:
+			warnings.addf("%s: the role %s does not exist (anymore)", key, role)
+		}
+	}
+	checkChannel := func(key string, channel string) {
+		if !isSnowflake(channel) {
+			problems.addf("%s: %q is no channel ID", key, channel)
+		}
+	}
+
+	for _, name := range settings.trackNames() {
+		track := settings.Tracks[name]
+		trackKey := fmt.Sprintf("%s.Tracks.%s", key, name)
+		if !trackNamePattern.MatchString(name) {
+			problems.addf("%s: the track name may only contain up to 32 lowercase letters, digits, - and _", trackKey)
+		}
+
+		seen := map[string]bool{}
+		for n, rank := range track.RankRoles {
+			rankKey := fmt.Sprintf("%s.RankRoles[%d]", trackKey, n)
+			checkRole(rankKey+".Role", rank.Role)
+			if seen[rank.Role] {
+				problems.addf("%s.Role: the role %s is used by more than one ranking role", rankKey, rank.Role)
+			}
+			seen[rank.Role] = true
+			if rank.From < 1 {
+				problems.addf("%s.From is %d, ranks start with 1", rankKey, rank.From)
+			}
+			if rank.To < rank.From {
+				problems.addf("%s.To is %d, it has to be at least From (%d)", rankKey, rank.To, rank.From)
+			}
+			if rank.KeepTo != 0 && rank.KeepTo < rank.To {
+				problems.addf("%s.KeepTo is %d, it has to be 0 or at least To (%d)", rankKey, rank.KeepTo, rank.To)
+			}
+			if rank.GraceHours < 0 {
+				problems.addf("%s.GraceHours is %d, it cannot be negative", rankKey, rank.GraceHours)
+			}
+		}
+
+		for _, role := range slices.Sorted(maps.Keys(track.RewardRoles)) {
+			reward := track.RewardRoles[role]
+			rewardKey := fmt.Sprintf("%s.RewardRoles.%s", trackKey, role)
+			checkRole(rewardKey, role)
+			if reward.KeepTarget > reward.Target {
+				problems.addf("%s.KeepTarget is %d, it cannot be above Target (%d)", rewardKey, reward.KeepTarget, reward.Target)
+			}
+			if reward.GraceHours < 0 {
+				problems.addf("%s.GraceHours is %d, it cannot be negative", rewardKey, reward.GraceHours)
+			}
+			if _, err := parseAggregation(reward.Aggregation.String()); err != nil {
+				problems.addf("%s.Aggregation: %s", rewardKey, err)
+			}
+		}
+
+		for _, series := range slices.Sorted(maps.Keys(track.SeriesWeights)) {
+			weight := track.SeriesWeights[series]
+			if !slices.Contains(allSeries, series) {
+				problems.addf("%s.SeriesWeights: unknown series %q, known are %s", trackKey, series, strings.Join(allSeries, ", "))
+			} else if weight < 0 {
+				problems.addf("%s.SeriesWeights.%s is %g, it cannot be negative", trackKey, series, weight)
+			}
+		}
+
+		filter := track.metricChannelFilter
+		for _, channel := range filter.IncludeCategories.ToSlice() {
+			checkChannel(trackKey+".MetricChannels.IncludeCategories", channel)
+		}
+		for _, channel := range filter.IncludeChannels.ToSlice() {
+			checkChannel(trackKey+".MetricChannels.IncludeChannels", channel)
+		}
+		for _, channel := range filter.ExcludeChannels.ToSlice() {
+			checkChannel(trackKey+".MetricChannels.ExcludeChannels", channel)
+		}
+		for _, pattern := range append(filter.IncludePatterns.ToSlice(), filter.ExcludePatterns.ToSlice()...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				problems.addf("%s.MetricChannels: %q is no valid name pattern", trackKey, pattern)
+			}
+		}
+	}
+
+	for _, entry := range settings.Scoring.LengthPoints {
+		if entry.MinLength < 0 {
+			problems.addf("%s.Scoring.LengthPoints: the minimum length %d cannot be negative", key, entry.MinLength)
+		}
+	}
+	for _, channel := range slices.Sorted(maps.Keys(settings.Scoring.ChannelMultipliers)) {
+		multiplier := settings.Scoring.ChannelMultipliers[channel]
+		checkChannel(key+".Scoring.ChannelMultipliers", channel)
+		if multiplier < 0 {
+			problems.addf("%s.Scoring.ChannelMultipliers.%s is %g, it cannot be negative", key, channel, multiplier)
+		}
+	}
+
+	if settings.Spam.CooldownSeconds < 0 {
+		problems.addf("%s.Spam.CooldownSeconds is %d, use 0 to disable the cooldown", key, settings.Spam.CooldownSeconds)
+	}
+	if settings.Spam.DuplicateWindowSeconds < 0 {
+		problems.addf("%s.Spam.DuplicateWindowSeconds is %d, use 0 to disable the detection", key, settings.Spam.DuplicateWindowSeconds)
+	}
+
+	if settings.AuditChannel != "" {
+		checkChannel(key+".AuditChannel", settings.AuditChannel)
+	}
+	if !slices.Contains(announcementDeliveries, settings.Announcements.Delivery) {
+		problems.addf("%s.Announcements.Delivery %q is unknown, use one of %s", key, settings.Announcements.Delivery, strings.Join(announcementDeliveries, ", "))
+	}
+	if settings.Announcements.Delivery == AnnouncementsChannel && settings.Announcements.Channel == "" {
+		problems.addf("%s.Announcements.Channel is required to announce in a channel", key)
+	} else if settings.Announcements.Channel != "" {
+		checkChannel(key+".Announcements.Channel", settings.Announcements.Channel)
+	}
+
+	for _, user := range settings.Exclusions.Users {
+		if !isSnowflake(user) {
+			problems.addf("%s.Exclusions.Users: %q is no user ID", key, user)
+		}
+	}
+	for _, role := range settings.Exclusions.Roles {
+		checkRole(key+".Exclusions.Roles", role)
+	}
+
+	return problems, warnings
+}
+
+// warnSettingsProblems logs the problems of the settings of the guild, e.g. roles deleted since the settings were loaded.
+func warnSettingsProblems(guild string) {
+	problems, warnings := guildSettingsProblems(guild, guildSettings(guild))
+	for _, problem := range append(problems, warnings...) {
+		log.Printf("Settings problem: %s", problem)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestParseSettingsMigrations(t *testing.T) {
+	tests := []struct {
+		name        string
+		legacyGuild string
+		toml        string
+
+		guild         string
+		tracks        []string
+		rankRoles     []RankRoleSettings
+		rewardRoles   map[string]RewardRoleSettings
+		seriesWeights map[string]float64
+		channels      []string
+		location      *time.Location
+		problems      []string
+	}{
+		{
+			name:        "single guild",
+			legacyGuild: "100000000000000001",
+			toml: `
+NumTrackedDays = 14
+KingsRole = "200000000000000001"
+
+[RewardRole]
+200000000000000002 = 50
+
+[Cron]
+SaveMetrics = "0 */10 * * * *"
+UpdateRewards = "*/5 * * * *"
+CumulationStep = "*/5 * * * *"
+
+[MetricChannels]
+IncludeCategories = []
+IncludeChannels = ["300000000000000001"]
+ExcludeChannels = []
+`,
+			guild:  "100000000000000001",
+			tracks: []string{DefaultTrack},
+			rankRoles: []RankRoleSettings{
+				{Role: "200000000000000001", From: 1, To: 6},
+			},
+			rewardRoles: map[string]RewardRoleSettings{
+				"200000000000000002": {Target: 50, Aggregation: Aggregation{Function: AggregationMedian}},
+			},
+			seriesWeights: defaultSeriesWeights(),
+			channels:      []string{"300000000000000001"},
+			location:      time.UTC,
+		},
+		{
+			name: "guilds without tracks",
+			toml: `
+Version = 1
+
+[Guilds.100000000000000002]
+NumTrackedDays = 7
+Timezone = "Europe/Berlin"
+
+[[Guilds.100000000000000002.RankRoles]]
+Role = "200000000000000003"
+From = 5
+To = 3
+
+[Guilds.100000000000000002.RewardRoles.200000000000000004]
+Target = 20
+KeepTarget = 10
+
+[Guilds.100000000000000002.SeriesWeights]
+messages = 1.0
+voice = 0.5
+
+[Guilds.100000000000000002.MetricChannels]
+IncludeChannels = ["300000000000000002"]
+`,
+			guild:  "100000000000000002",
+			tracks: []string{DefaultTrack},
+			rankRoles: []RankRoleSettings{
+				{Role: "200000000000000003", From: 5, To: 3},
+			},
+			rewardRoles: map[string]RewardRoleSettings{
+				"200000000000000004": {Target: 20, KeepTarget: 10},
+			},
+			seriesWeights: map[string]float64{SeriesMessages: 1, SeriesVoice: 0.5},
+			channels:      []string{"300000000000000002"},
+			location:      mustLoadLocation(t, "Europe/Berlin"),
+			problems: []string{
+				"Guilds.100000000000000002.Tracks.default.RankRoles[0].To is 3, it has to be at least From (5)",
+			},
+		},
+		{
+			name: "reward role and kings role",
+			toml: `
+Version = 2
+
+[Guilds.100000000000000003]
+NumTrackedDays = 7
+Timezone = "Mars/Olympus_Mons"
+KingsRole = "200000000000000005"
+
+[Guilds.100000000000000003.RewardRole]
+200000000000000006 = 30
+
+[Guilds.100000000000000003.Tracks.voice]
+[Guilds.100000000000000003.Tracks.voice.SeriesWeights]
+voice = 1.0
+`,
+			guild:  "100000000000000003",
+			tracks: []string{DefaultTrack, "voice"},
+			rankRoles: []RankRoleSettings{
+				{Role: "200000000000000005", From: 1, To: 6},
+			},
+			rewardRoles: map[string]RewardRoleSettings{
+				"200000000000000006": {Target: 30, Aggregation: Aggregation{Function: AggregationMedian}},
+			},
+			seriesWeights: defaultSeriesWeights(),
+			location:      time.UTC,
+			problems: []string{
+				`Guilds.100000000000000003.Timezone "Mars/Olympus_Mons" is no IANA timezone like Europe/Berlin`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			previous := legacyGuild
+			legacyGuild = test.legacyGuild
+			t.Cleanup(func() { legacyGuild = previous })
+
+			data, migrated, err := parseSettings([]byte(test.toml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !migrated || data.Version != settingsVersion {
+				t.Errorf("parseSettings returned version %d and migrated %t, want version %d and migrated", data.Version, migrated, settingsVersion)
+			}
+
+			settings, ok := data.Guilds[test.guild]
+			if !ok {
+				t.Fatalf("parseSettings returned the guilds %v, want %s", slices.Collect(maps.Keys(data.Guilds)), test.guild)
+			}
+			if names := settings.trackNames(); !slices.Equal(names, test.tracks) {
+				t.Errorf("Tracks are %v, want %v", names, test.tracks)
+			}
+			if settings.RankRoles != nil || settings.RewardRoles != nil || settings.RewardRole != nil || settings.KingsRole != "" {
+				t.Errorf("the legacy fields were not cleared after the migration")
+			}
+			if settings.Exclusions.IgnoreBots {
+				t.Errorf("bots are ignored after the migration, they were counted before")
+			}
+
+			track := settings.Tracks[DefaultTrack]
+			var rankRoles []RankRoleSettings
+			for _, rank := range track.RankRoles {
+				rankRoles = append(rankRoles, *rank)
+			}
+			if !reflect.DeepEqual(rankRoles, test.rankRoles) {
+				t.Errorf("RankRoles are %+v, want %+v", rankRoles, test.rankRoles)
+			}
+			rewardRoles := map[string]RewardRoleSettings{}
+			for role, reward := range track.RewardRoles {
+				rewardRoles[role] = *reward
+			}
+			if !reflect.DeepEqual(rewardRoles, test.rewardRoles) {
+				t.Errorf("RewardRoles are %+v, want %+v", rewardRoles, test.rewardRoles)
+			}
+			if !maps.Equal(track.SeriesWeights, test.seriesWeights) {
+				t.Errorf("SeriesWeights are %v, want %v", track.SeriesWeights, test.seriesWeights)
+			}
+			if channels := track.metricChannelFilter.IncludeChannels.ToSlice(); !slices.Equal(channels, test.channels) {
+				t.Errorf("the included channels are %v, want %v", channels, test.channels)
+			}
+			if settings.location().String() != test.location.String() {
+				t.Errorf("location is %s, want %s", settings.location(), test.location)
+			}
+
+			var problems []string
+			var settingsError *SettingsError
+			if err = validateSettings(data); errors.As(err, &settingsError) {
+				problems = settingsError.Problems
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(problems, test.problems) {
+				t.Errorf("validateSettings returned the problems %q, want %q", problems, test.problems)
+			}
+		})
+	}
+}
+
+func TestParseSettingsSingleGuildNeedsGuild(t *testing.T) {
+	previous := legacyGuild
+	legacyGuild = ""
+	t.Cleanup(func() { legacyGuild = previous })
+
+	if _, _, err := parseSettings([]byte("NumTrackedDays = 7\n")); err == nil {
+		t.Error("parseSettings migrated single guild settings without a guild")
+	}
+}
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("timezone %s is not available: %s", name, err)
+	}
+	return location
+}
+
+func TestParseSettingsKeepsExclusions(t *testing.T) {
+	data, _, err := parseSettings([]byte(`
+Version = 3
+
+[Guilds.100000000000000004]
+NumTrackedDays = 7
+
+[Guilds.100000000000000004.Exclusions]
+Users = ["400000000000000001"]
+IgnoreBots = true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exclusions := data.Guilds["100000000000000004"].Exclusions
+	if !exclusions.IgnoreBots || !slices.Equal(exclusions.Users, []string{"400000000000000001"}) || exclusions.Roles == nil {
+		t.Errorf("the exclusions are %+v, want the stored ones", exclusions)
+	}
+
+	if !newGuildSettings().Exclusions.IgnoreBots {
+		t.Error("new guilds do not ignore bots by default")
+	}
+}
+
+func TestValidateSettingsMissingRoles(t *testing.T) {
+	const guild = "100000000000000005"
+	roleCache.mutex.Lock()
+	roleCache.Guilds[guild] = map[string]*discordgo.Role{
+		"200000000000000007": {ID: "200000000000000007"},
+	}
+	roleCache.mutex.Unlock()
+	t.Cleanup(func() {
+		roleCache.mutex.Lock()
+		delete(roleCache.Guilds, guild)
+		roleCache.mutex.Unlock()
+	})
+
+	data, _, err := parseSettings([]byte(`
+Version = 3
+
+[Guilds.100000000000000005]
+NumTrackedDays = 0
+
+[[Guilds.100000000000000005.Tracks.default.RankRoles]]
+Role = "200000000000000008"
+From = 1
+To = 3
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the deleted role is only a warning, the invalid number of days is still a problem
+	var settingsError *SettingsError
+	if err = validateSettings(data); !errors.As(err, &settingsError) {
+		t.Fatalf("validateSettings returned %v, want a SettingsError", err)
+	}
+	want := []string{"Guilds.100000000000000005.NumTrackedDays is 0, at least 1 day has to be tracked"}
+	if !slices.Equal(settingsError.Problems, want) {
+		t.Errorf("validateSettings returned the problems %q, want %q", settingsError.Problems, want)
+	}
+
+	_, warnings := guildSettingsProblems(guild, data.Guilds[guild])
+	want = []string{"Guilds.100000000000000005.Tracks.default.RankRoles[0].Role: the role 200000000000000008 does not exist (anymore)"}
+	if !slices.Equal(warnings, want) {
+		t.Errorf("guildSettingsProblems returned the warnings %q, want %q", warnings, want)
+	}
+}
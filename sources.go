@@ -0,0 +1,374 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	SeriesMessages          = "messages"
+	SeriesVoice             = "voice"
+	SeriesReactionsGiven    = "reactions_given"
+	SeriesReactionsReceived = "reactions_received"
+	SeriesThreads           = "threads"
+)
+
+var seriesNames = map[string]string{
+	SeriesMessages:          "Messages",
+	SeriesVoice:             "Voice Minutes",
+	SeriesReactionsGiven:    "Reactions Given",
+	SeriesReactionsReceived: "Reactions Received",
+	SeriesThreads:           "Thread Messages",
+}
+
+var allSeries = []string{SeriesMessages, SeriesVoice, SeriesReactionsGiven, SeriesReactionsReceived, SeriesThreads}
+
+func defaultSeriesWeights() map[string]float64 {
+	return map[string]float64{
+		SeriesMessages: 1,
+	}
+}
+
+func formatSeriesWeights(weights map[string]float64) string {
+	var parts []string
+	for _, series := range allSeries {
+		if weight, ok := weights[series]; ok {
+			parts = append(parts, fmt.Sprintf("%s x%g", seriesNames[series], weight))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// messageChannel returns the channel from the state cache or requests it if it is not cached.
+func messageChannel(s *discordgo.Session, channelID string) *discordgo.Channel {
+	channel, err := s.State.Channel(channelID)
+	if err == nil {
+		return channel
+	}
+	channel, err = s.Channel(channelID)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return channel
+}
+
+type voiceSession struct {
+	since   time.Time
+	channel string
+}
+
+var voiceSessions = struct {
+	mutex  sync.Mutex
+	Guilds map[string]map[string]*voiceSession
+}{
+	Guilds: map[string]map[string]*voiceSession{},
+}
+
+// countsVoice checks whether time spent in the voice state counts as activity.
+func countsVoice(s *discordgo.Session, state *discordgo.VoiceState) bool {
+	if state.ChannelID == "" || state.Deaf || state.SelfDeaf {
+		return false
+	}
+	settings := guildSettings(state.GuildID)
+	if state.Member != nil && state.Member.User != nil {
+		if settings.Exclusions.excludesMember(state.GuildID, state.Member.User, state.Member) {
+			return false
+		}
+	} else if settings.Exclusions.excludesCached(state.GuildID, state.UserID) {
+		return false
+	}
+	if guild, err := s.State.Guild(state.GuildID); err == nil && guild.AfkChannelID == state.ChannelID {
+		return false
+	}
+	for _, track := range settings.Tracks {
+		if track.metricChannelFilter.matchCachedID(state.ChannelID) {
+			return true
+		}
+	}
+	return false
+}
+
+// creditVoice adds the whole minutes spent since the session started to the tracks of the channel
+// and keeps the remainder in the session. The caller has to hold the voice session mutex.
+func creditVoice(guild string, user string, session *voiceSession, now time.Time) {
+	minutes := int64(now.Sub(session.since) / time.Minute)
+	if minutes <= 0 {
+		return
+	}
+	session.since = session.since.Add(time.Duration(minutes) * time.Minute)
+	for name, track := range guildSettings(guild).Tracks {
+		if track.metricChannelFilter.matchCachedID(session.channel) {
+			trackMetrics(guild, name).addPoints(SeriesVoice, user, minutes, now)
+		}
+	}
+}
+
+func updateVoiceState(s *discordgo.Session, state *discordgo.VoiceState) {
+	voiceSessions.mutex.Lock()
+	defer voiceSessions.mutex.Unlock()
+
+	sessions, ok := voiceSessions.Guilds[state.GuildID]
+	if !ok {
+		sessions = map[string]*voiceSession{}
+		voiceSessions.Guilds[state.GuildID] = sessions
+	}
+
+	now := time.Now()
+	if session, ok := sessions[state.UserID]; ok {
+		creditVoice(state.GuildID, state.UserID, session, now)
+		delete(sessions, state.UserID)
+	}
+
+	if countsVoice(s, state) {
+		sessions[state.UserID] = &voiceSession{
+			since:   now,
+			channel: state.ChannelID,
+		}
+	}
+}
+
+func voiceStateUpdate(s *discordgo.Session, v *discordgo.VoiceStateUpdate) {
+	if v.GuildID == "" {
+		return
+	}
+	updateVoiceState(s, v.VoiceState)
+}
+
+// startVoiceSessions starts sessions for all members already in voice channels when the guild becomes available.
+func startVoiceSessions(s *discordgo.Session, guild *discordgo.Guild) {
+	for _, state := range guild.VoiceStates {
+		state.GuildID = guild.ID
+		updateVoiceState(s, state)
+	}
+}
+
+// flushVoice credits the minutes of all running voice sessions, so long sessions show up before they end.
+func flushVoice() {
+	voiceSessions.mutex.Lock()
+	defer voiceSessions.mutex.Unlock()
+
+	now := time.Now()
+	for guild, sessions := range voiceSessions.Guilds {
+		for user, session := range sessions {
+			creditVoice(guild, user, session, now)
+		}
+	}
+}
+
+// messageAuthor returns the author of a message from the state cache or requests the message if it is not cached.
+func messageAuthor(s *discordgo.Session, channelID string, messageID string) *discordgo.User {
+	message, err := s.State.Message(channelID, messageID)
+	if err != nil {
+		message, err = s.ChannelMessage(channelID, messageID)
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
+	}
+	return message.Author
+}
+
+// CountedReaction is a reaction which earned points. It earns them only once and loses them when it is removed.
+type CountedReaction struct {
+	// Date is the calendar date the points were added to.
+	Date string
+	// Receiver is the author of the message who received points, empty if nobody did.
+	Receiver string
+}
+
+// reactionKey identifies the reaction of a user with an emoji on a message.
+func reactionKey(r *discordgo.MessageReaction) string {
+	return fmt.Sprintf("%s|%s|%s", r.MessageID, r.UserID, r.Emoji.APIName())
+}
+
+// reactionSpamKey keeps the rate limit of reactions apart from the one of messages.
+func reactionSpamKey(user string) string {
+	return "reactions|" + user
+}
+
+// addReaction adds the points of a reaction given by the user unless it was already counted or is suppressed as spam.
+// The receiver gets points for the reaction unless it is empty.
+func (m *MetricStore) addReaction(settings SpamSettings, key string, user string, receiver string, t time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.Reactions[key]; ok {
+		return
+	}
+	if !m.allowPoints(settings, reactionSpamKey(user), "", t) {
+		return
+	}
+
+	if m.Reactions == nil {
+		m.Reactions = map[string]CountedReaction{}
+	}
+	m.Reactions[key] = CountedReaction{
+		Date:     t.In(guildSettings(m.guild).location()).Format(dateFormat),
+		Receiver: receiver,
+	}
+	m.add(SeriesReactionsGiven, user, 1, t)
+	if receiver != "" {
+		m.add(SeriesReactionsReceived, receiver, 1, t)
+	}
+}
+
+// removeReaction removes the points of a counted reaction from the day it was counted.
+func (m *MetricStore) removeReaction(key string, user string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	reaction, ok := m.Reactions[key]
+	if !ok {
+		return
+	}
+	delete(m.Reactions, key)
+
+	if given, ok := m.Series[SeriesReactionsGiven]; ok {
+		given.add(user, reaction.Date, -1)
+	}
+	if received, ok := m.Series[SeriesReactionsReceived]; ok && reaction.Receiver != "" {
+		received.add(reaction.Receiver, reaction.Date, -1)
+	}
+}
+
+// reactionTracks returns the tracks of the guild that score reactions.
+func reactionTracks(settings *GuildSettings) []string {
+	var tracks []string
+	for name, track := range settings.Tracks {
+		if track.SeriesWeights[SeriesReactionsGiven] != 0 || track.SeriesWeights[SeriesReactionsReceived] != 0 {
+			tracks = append(tracks, name)
+		}
+	}
+	return tracks
+}
+
+func metricReaction(s *discordgo.Session, r *discordgo.MessageReactionAdd) {
+	if r.GuildID == "" || r.UserID == s.State.User.ID {
+		return
+	}
+	settings := guildSettings(r.GuildID)
+	if r.Member != nil && r.Member.User != nil {
+		if settings.Exclusions.excludesMember(r.GuildID, r.Member.User, r.Member) {
+			return
+		}
+	} else if settings.Exclusions.excludesCached(r.GuildID, r.UserID) {
+		return
+	}
+	tracks := reactionTracks(settings)
+	if len(tracks) == 0 {
+		return
+	}
+	channel := messageChannel(s, r.ChannelID)
+	if channel == nil {
+		return
+	}
+
+	now := time.Now()
+	var author *discordgo.User
+	authorFetched := false
+	for _, name := range tracks {
+		track := settings.Tracks[name]
+		if !track.metricChannelFilter.matchCachedChannel(channel) {
+			continue
+		}
+
+		receiver := ""
+		if track.SeriesWeights[SeriesReactionsReceived] != 0 {
+			if !authorFetched {
+				author = messageAuthor(s, r.ChannelID, r.MessageID)
+				authorFetched = true
+				if author != nil && (author.Bot || author.ID == r.UserID || settings.Exclusions.excludesCached(r.GuildID, author.ID)) {
+					author = nil
+				}
+			}
+			if author != nil {
+				receiver = author.ID
+			}
+		}
+		trackMetrics(r.GuildID, name).addReaction(settings.Spam, reactionKey(r.MessageReaction), r.UserID, receiver, now)
+	}
+}
+
+// metricReactionRemove takes back the points of a removed reaction, so reacting again does not earn more points.
+func metricReactionRemove(s *discordgo.Session, r *discordgo.MessageReactionRemove) {
+	if r.GuildID == "" || r.UserID == s.State.User.ID {
+		return
+	}
+	for _, name := range reactionTracks(guildSettings(r.GuildID)) {
+		trackMetrics(r.GuildID, name).removeReaction(reactionKey(r.MessageReaction), r.UserID)
+	}
+}
+
+// metricThreadMessage counts a message in a tracked thread or forum post in addition to its message points.
+func metricThreadMessage(metrics *MetricStore, m *discordgo.MessageCreate) {
+	metrics.addPoints(SeriesThreads, m.Author.ID, 1, m.Timestamp)
+}
+
+func init() {
+	maps.Copy(messageComponents, map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+		"edit_sources": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			name, _, ok := customIDTrack(strings.Split(i.MessageComponentData().CustomID, "|"), 0)
+			if !ok {
+				return
+			}
+			weights := guildSettings(i.GuildID).track(name).SeriesWeights
+
+			var components []discordgo.MessageComponent
+			for _, series := range allSeries {
+				components = append(components, scoringTextInput(seriesNames[series]+" Weight", series, strconv.FormatFloat(weights[series], 'g', -1, 64)))
+			}
+
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseModal,
+				Data: &discordgo.InteractionResponseData{
+					Title:      "Edit Metric Sources",
+					Components: components,
+					CustomID:   fmt.Sprintf("edit_sources|%s", name),
+				},
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		},
+	})
+
+	maps.Copy(modals, map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, ids []string){
+		"edit_sources": func(s *discordgo.Session, i *discordgo.InteractionCreate, ids []string) {
+			name, _, ok := customIDTrack(ids, 0)
+			if !ok {
+				return
+			}
+
+			weights := map[string]float64{}
+			for _, row := range i.ModalSubmitData().Components {
+				input := row.(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput)
+				weight, err := strconv.ParseFloat(input.Value, 64)
+				if err != nil || weight < 0 || !slices.Contains(allSeries, input.CustomID) {
+					return
+				}
+				if weight != 0 {
+					weights[input.CustomID] = weight
+				}
+			}
+
+			err := updateTrackSettings(i.GuildID, name, func(track *TrackSettings) error {
+				track.SeriesWeights = weights
+				return nil
+			})
+			if err != nil {
+				return
+			}
+
+			updateTrackMessage(s, i, name)
+		},
+	})
+}
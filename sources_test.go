@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// useMemoryStore replaces the store by an empty memory store for the test.
+func useMemoryStore(t *testing.T) {
+	t.Helper()
+
+	previous := store
+	store = NewMemoryStore()
+	t.Cleanup(func() { store = previous })
+}
+
+func TestReactionsSurviveRestart(t *testing.T) {
+	useMemoryStore(t)
+
+	const guild, user, author = "100000000000000001", "400000000000000001", "400000000000000002"
+	const key = "500000000000000001|" + user + "|👍"
+	now := time.Now()
+	date := now.In(guildSettings(guild).location()).Format(dateFormat)
+
+	metrics := &MetricStore{guild: guild, track: DefaultTrack, Series: map[string]DailyPoints{}}
+	metrics.addReaction(SpamSettings{}, key, user, author, now)
+	metrics.addReaction(SpamSettings{}, key, user, author, now)
+	if given := metrics.Series[SeriesReactionsGiven][user][date]; given != 1 {
+		t.Fatalf("reacting twice gave %d points, want 1", given)
+	}
+	metrics.store()
+
+	restarted := &MetricStore{guild: guild, track: DefaultTrack, Series: map[string]DailyPoints{}}
+	if err := restarted.read(); err != nil {
+		t.Fatal(err)
+	}
+	restarted.addReaction(SpamSettings{}, key, user, author, now)
+	if given := restarted.Series[SeriesReactionsGiven][user][date]; given != 1 {
+		t.Errorf("reacting again after a restart gave %d points in total, want 1", given)
+	}
+
+	restarted.removeReaction(key, user)
+	if given := restarted.Series[SeriesReactionsGiven][user][date]; given != 0 {
+		t.Errorf("removing the reaction after a restart left %d given points, want 0", given)
+	}
+	if received := restarted.Series[SeriesReactionsReceived][author][date]; received != 0 {
+		t.Errorf("removing the reaction after a restart left %d received points, want 0", received)
+	}
+}
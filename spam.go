@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+type SpamSettings struct {
+	// CooldownSeconds is the time it takes to regain one message earning points, 0 disables the cooldown.
+	CooldownSeconds int
+	// Burst is the number of messages earning points in quick succession before the cooldown applies.
+	Burst int
+	// DuplicateWindowSeconds is the time in which repeated content earns no points, 0 disables the detection.
+	DuplicateWindowSeconds int
+}
+
+func defaultSpamSettings() SpamSettings {
+	return SpamSettings{
+		CooldownSeconds:        0,
+		Burst:                  1,
+		DuplicateWindowSeconds: 0,
+	}
+}
+
+// spamState is a token bucket per user together with the recently sent contents.
+type spamState struct {
+	tokens   float64
+	last     time.Time
+	contents map[string]time.Time
+}
+
+func normalizeContent(content string) string {
+	return strings.Join(strings.Fields(strings.ToLower(content)), " ")
+}
+
+// allowPoints checks whether a message of the user may earn points and records it.
+// The caller has to hold the mutex.
+func (m *MetricStore) allowPoints(settings SpamSettings, user string, content string, t time.Time) bool {
+	if m.spam == nil {
+		m.spam = map[string]*spamState{}
+	}
+	state, ok := m.spam[user]
+	if !ok {
+		state = &spamState{
+			tokens:   float64(max(settings.Burst, 1)),
+			last:     t,
+			contents: map[string]time.Time{},
+		}
+		m.spam[user] = state
+	}
+
+	allowed := true
+
+	if settings.DuplicateWindowSeconds > 0 {
+		window := time.Duration(settings.DuplicateWindowSeconds) * time.Second
+		for c, sent := range state.contents {
+			if t.Sub(sent) > window {
+				delete(state.contents, c)
+			}
+		}
+		content = normalizeContent(content)
+		if content != "" {
+			if _, ok := state.contents[content]; ok {
+				allowed = false
+			}
+			state.contents[content] = t
+		}
+	}
+
+	if settings.CooldownSeconds > 0 {
+		cooldown := time.Duration(settings.CooldownSeconds) * time.Second
+		state.tokens = min(state.tokens+float64(t.Sub(state.last))/float64(cooldown), float64(max(settings.Burst, 1)))
+		state.last = t
+		// only messages earning points take a token, a suppressed duplicate does not
+		if state.tokens < 1 {
+			allowed = false
+		} else if allowed {
+			state.tokens--
+		}
+	}
+
+	return allowed
+}
+
+// addMessagePoints adds the points of a message unless it is suppressed as spam.
+func (m *MetricStore) addMessagePoints(user string, content string, points int64, t time.Time) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	settings := guildSettings(m.guild)
+	date := t.In(settings.location()).Format(dateFormat)
+
+	if !m.allowPoints(settings.Spam, user, content, t) {
+		if m.Suppressed == nil {
+			m.Suppressed = DailyPoints{}
+		}
+		m.Suppressed.add(user, date, 1)
+		return false
+	}
+
+	m.add(SeriesMessages, user, points, t)
+	return true
+}
+
+// suppressed returns the number of messages of the user suppressed as spam during the tracked days.
+// The caller has to hold the mutex.
+func (m *MetricStore) suppressed(user string, now time.Time) int64 {
+	settings := guildSettings(m.guild)
+	oldest := now.In(settings.location()).AddDate(0, 0, 1-settings.NumTrackedDays).Format(dateFormat)
+
+	var sum int64 = 0
+	for date, count := range m.Suppressed[user] {
+		if date >= oldest {
+			sum += count
+		}
+	}
+	return sum
+}
+
+// pruneSpam removes the spam state of users whose cooldown and duplicate window elapsed.
+// The caller has to hold the mutex.
+func (m *MetricStore) pruneSpam(settings SpamSettings, oldest string, now time.Time) {
+	expiry := time.Duration(max(settings.CooldownSeconds*max(settings.Burst, 1), settings.DuplicateWindowSeconds)) * time.Second
+	window := time.Duration(settings.DuplicateWindowSeconds) * time.Second
+	for user, state := range m.spam {
+		// contents are otherwise only expired when the user posts again
+		maps.DeleteFunc(state.contents, func(_ string, sent time.Time) bool {
+			return now.Sub(sent) > window
+		})
+		if now.Sub(state.last) > expiry && len(state.contents) == 0 {
+			delete(m.spam, user)
+		}
+	}
+
+	m.Suppressed.prune(oldest)
+}
+
+func init() {
+	maps.Copy(messageComponents, map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+		"edit_spam": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			spam := guildSettings(i.GuildID).Spam
+
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseModal,
+				Data: &discordgo.InteractionResponseData{
+					Title: "Edit Anti-Spam",
+					Components: []discordgo.MessageComponent{
+						scoringTextInput("Cooldown in Seconds (0 to disable)", "cooldown", strconv.Itoa(spam.CooldownSeconds)),
+						scoringTextInput("Messages before Cooldown", "burst", strconv.Itoa(spam.Burst)),
+						scoringTextInput("Duplicate Window in Seconds (0 to disable)", "duplicate_window", strconv.Itoa(spam.DuplicateWindowSeconds)),
+					},
+					CustomID: "edit_spam",
+				},
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		},
+	})
+
+	maps.Copy(modals, map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, ids []string){
+		"edit_spam": func(s *discordgo.Session, i *discordgo.InteractionCreate, ids []string) {
+			values := map[string]int{}
+			for _, row := range i.ModalSubmitData().Components {
+				input := row.(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput)
+				value, err := strconv.Atoi(input.Value)
+				if err != nil || value < 0 {
+					return
+				}
+				values[input.CustomID] = value
+			}
+
+			err := updateGuildSettings(i.GuildID, func(settings *GuildSettings) error {
+				settings.Spam = SpamSettings{
+					CooldownSeconds:        values["cooldown"],
+					Burst:                  max(values["burst"], 1),
+					DuplicateWindowSeconds: values["duplicate_window"],
+				}
+				return nil
+			})
+			if err != nil {
+				return
+			}
+
+			updateSettingsMessage(s, i)
+		},
+	})
+}
+
+func formatSpamSettings(spam SpamSettings) string {
+	cooldown := "off"
+	if spam.CooldownSeconds > 0 {
+		cooldown = fmt.Sprintf("%d messages per %ds", spam.Burst, spam.CooldownSeconds*spam.Burst)
+	}
+	duplicates := "off"
+	if spam.DuplicateWindowSeconds > 0 {
+		duplicates = fmt.Sprintf("%ds", spam.DuplicateWindowSeconds)
+	}
+	return fmt.Sprintf("**Cooldown:** %s, **Duplicate Window:** %s", cooldown, duplicates)
+}
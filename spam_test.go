@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllowPoints(t *testing.T) {
+	settings := SpamSettings{CooldownSeconds: 60, Burst: 2, DuplicateWindowSeconds: 300}
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	const user = "400000000000000001"
+
+	tests := []struct {
+		offset  time.Duration
+		content string
+		allowed bool
+	}{
+		{0, "hello", true},
+		// a suppressed duplicate takes no token
+		{time.Second, "hello", false},
+		{2 * time.Second, "HELLO ", false},
+		{3 * time.Second, "how are you", true},
+		// the burst is used up
+		{4 * time.Second, "anything new", false},
+		// one token regained after the cooldown
+		{64 * time.Second, "fine", true},
+		{65 * time.Second, "and you", false},
+		// the duplicate window elapsed
+		{6 * time.Minute, "hello", true},
+	}
+
+	m := &MetricStore{}
+	for _, test := range tests {
+		if allowed := m.allowPoints(settings, user, test.content, start.Add(test.offset)); allowed != test.allowed {
+			t.Errorf("allowPoints of %q after %s returned %t, want %t", test.content, test.offset, allowed, test.allowed)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var ErrNotStored = errors.New("key not stored")
+
+// Store persists the data of the bot like settings and metrics as named blobs.
+type Store interface {
+	// Load returns the data stored for the key or ErrNotStored if there is none.
+	Load(key string) ([]byte, error)
+	Save(key string, data []byte) error
+	Delete(key string) error
+	Keys() ([]string, error)
+	Close() error
+}
+
+var store Store
+
+func openStore(storeType string, path string) (Store, error) {
+	switch storeType {
+	case "", "file":
+		if path == "" {
+			path = "."
+		}
+		return &FileStore{Dir: path}, nil
+	case "bolt":
+		if path == "" {
+			path = "alice.db"
+		}
+		return openBoltStore(path)
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown store type %q", storeType)
+	}
+}
+
+// copyStore copies all data of src into dst, overwriting existing keys.
+func copyStore(dst Store, src Store) error {
+	keys, err := src.Keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		data, err := src.Load(key)
+		if err != nil {
+			return err
+		}
+		if err = dst.Save(key, data); err != nil {
+			return err
+		}
+		log.Printf("Copied %s.", key)
+	}
+	return nil
+}
+
+// importStore copies the data of a store given as "type:path" into the selected store.
+func importStore(source string) error {
+	storeType, path, _ := strings.Cut(source, ":")
+	src, err := openStore(storeType, path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return copyStore(store, src)
+}
+
+// FileStore stores every key as a file in a directory.
+type FileStore struct {
+	Dir string
+}
+
+func (f *FileStore) Load(key string) ([]byte, error) {
+	b, err := os.ReadFile(filepath.Join(f.Dir, key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotStored
+	}
+	return b, err
+}
+
+// Save writes the data to a temporary file first and renames it afterwards,
+// so a crash or a full disk never leaves a partially written file behind.
+func (f *FileStore) Save(key string, data []byte) error {
+	path := filepath.Join(f.Dir, key)
+	tmp, err := os.CreateTemp(f.Dir, "."+key+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(f.Dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (f *FileStore) Delete(key string) error {
+	err := os.Remove(filepath.Join(f.Dir, key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (f *FileStore) Keys() ([]string, error) {
+	entries, err := os.ReadDir(f.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && (strings.HasSuffix(name, ".gob") || strings.HasSuffix(name, ".toml") || isBackupKey(name)) {
+			keys = append(keys, name)
+		}
+	}
+	return keys, nil
+}
+
+func (f *FileStore) Close() error {
+	return nil
+}
+
+// MemoryStore keeps all data in memory and loses it on exit.
+type MemoryStore struct {
+	mutex sync.Mutex
+	data  map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: map[string][]byte{}}
+}
+
+func (m *MemoryStore) Load(key string) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	data, ok := m.data[key]
+	if !ok {
+		return nil, ErrNotStored
+	}
+	return slices.Clone(data), nil
+}
+
+func (m *MemoryStore) Save(key string, data []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.data[key] = slices.Clone(data)
+	return nil
+}
+
+func (m *MemoryStore) Delete(key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.data, key)
+	return nil
+}
+
+func (m *MemoryStore) Keys() ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return slices.Sorted(maps.Keys(m.data)), nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
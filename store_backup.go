@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const backupTimeFormat = "20060102T150405Z"
+
+// BackupStore keeps timestamped generations of the data saved to an underlying store.
+// A new generation is created on save if the newest one is older than Interval,
+// and only the newest Generations generations are kept.
+type BackupStore struct {
+	Store
+	Generations int
+	Interval    time.Duration
+}
+
+func backupKey(key string, generation string) string {
+	return fmt.Sprintf("%s.%s.bak", key, generation)
+}
+
+func isBackupKey(key string) bool {
+	return strings.HasSuffix(key, ".bak")
+}
+
+// Backups returns the generations stored for the key, newest first.
+func (b *BackupStore) Backups(key string) ([]string, error) {
+	keys, err := b.Store.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	var generations []string
+	for _, k := range keys {
+		generation, ok := strings.CutPrefix(k, key+".")
+		if !ok || !isBackupKey(k) {
+			continue
+		}
+		generation = strings.TrimSuffix(generation, ".bak")
+		if _, err := time.Parse(backupTimeFormat, generation); err != nil {
+			continue
+		}
+		generations = append(generations, generation)
+	}
+	slices.Sort(generations)
+	slices.Reverse(generations)
+	return generations, nil
+}
+
+func (b *BackupStore) Save(key string, data []byte) error {
+	if b.Generations > 0 && !isBackupKey(key) {
+		generations, err := b.Backups(key)
+		if err != nil {
+			return err
+		}
+		newest := time.Time{}
+		if len(generations) > 0 {
+			newest, _ = time.Parse(backupTimeFormat, generations[0])
+		}
+		if time.Since(newest) >= b.Interval {
+			if err = b.backup(key, generations); err != nil {
+				log.Printf("Failed to back up %s: %e", key, err)
+			}
+		}
+	}
+
+	return b.Store.Save(key, data)
+}
+
+// backup stores the current data of the key as new generation and deletes generations exceeding the limit.
+func (b *BackupStore) backup(key string, generations []string) error {
+	data, err := b.Store.Load(key)
+	if err == ErrNotStored {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	generation := time.Now().UTC().Format(backupTimeFormat)
+	if err = b.Store.Save(backupKey(key, generation), data); err != nil {
+		return err
+	}
+	if !slices.Contains(generations, generation) {
+		generations = slices.Insert(generations, 0, generation)
+	}
+
+	for _, old := range generations[min(len(generations), b.Generations):] {
+		if err = b.Store.Delete(backupKey(key, old)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore replaces the data of the key with the given generation.
+// The current data is backed up first, so a restore can be undone.
+func (b *BackupStore) Restore(key string, generation string) error {
+	data, err := b.Store.Load(backupKey(key, generation))
+	if err != nil {
+		return err
+	}
+
+	generations, err := b.Backups(key)
+	if err != nil {
+		return err
+	}
+	if err = b.backup(key, generations); err != nil {
+		return err
+	}
+
+	return b.Store.Save(key, data)
+}
+
+func (m *MetricStore) restore(generation string) error {
+	backups, ok := store.(*BackupStore)
+	if !ok {
+		return fmt.Errorf("store does not keep backups")
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := backups.Restore(metricsKey(m.guild, m.track), generation); err != nil {
+		return err
+	}
+
+	return m.read()
+}
+
+func init() {
+	maps.Copy(commands, map[*discordgo.ApplicationCommand]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+		{
+			Name:                     "alice_restore",
+			Description:              "Rolls the metrics back to a previous backup.",
+			Type:                     discordgo.ChatApplicationCommand,
+			DefaultMemberPermissions: i64(0),
+			Options: []*discordgo.ApplicationCommandOption{
+				trackOption(),
+			},
+		}: func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			track := commandTrack(i)
+			content := fmt.Sprintf("Select the backup to restore the metrics%s from:", trackDescription(track))
+			var components []discordgo.MessageComponent
+
+			var generations []string
+			backups, ok := store.(*BackupStore)
+			if _, known := guildSettings(i.GuildID).Tracks[track]; ok && known {
+				var err error
+				generations, err = backups.Backups(metricsKey(i.GuildID, track))
+				if err != nil {
+					log.Println(err)
+				}
+			}
+
+			if len(generations) == 0 {
+				content = "There are no backups of the metrics."
+			} else {
+				var options []discordgo.SelectMenuOption
+				for _, generation := range generations[:min(len(generations), 25)] {
+					t, _ := time.Parse(backupTimeFormat, generation)
+					options = append(options, discordgo.SelectMenuOption{
+						Label: t.Format(time.RFC1123),
+						Value: generation,
+					})
+				}
+				components = []discordgo.MessageComponent{
+					discordgo.ActionsRow{
+						Components: []discordgo.MessageComponent{
+							discordgo.SelectMenu{
+								MenuType: discordgo.StringSelectMenu,
+								Options:  options,
+								CustomID: fmt.Sprintf("restore_metrics|%s", track),
+							},
+						},
+					},
+				}
+			}
+
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Content:    content,
+					Components: components,
+					Flags:      discordgo.MessageFlagsEphemeral,
+				},
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		},
+	})
+
+	maps.Copy(messageComponents, map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+		"restore_metrics": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			track, _, ok := customIDTrack(strings.Split(i.MessageComponentData().CustomID, "|"), 0)
+			if !ok {
+				return
+			}
+			generation := i.MessageComponentData().Values[0]
+
+			content := fmt.Sprintf("Restored metrics%s from backup %s.", trackDescription(track), generation)
+			if err := trackMetrics(i.GuildID, track).restore(generation); err != nil {
+				log.Printf("Failed to restore metrics of track %s of guild %s: %e", track, i.GuildID, err)
+				content = fmt.Sprintf("Failed to restore metrics: %s", err)
+			} else {
+				log.Printf("Restored metrics of track %s of guild %s from backup %s.", track, i.GuildID, generation)
+			}
+
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseUpdateMessage,
+				Data: &discordgo.InteractionResponseData{
+					Content:    content,
+					Components: []discordgo.MessageComponent{},
+				},
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		},
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testStoreRoundTrip checks that data saved to the store is loaded, listed and deleted again.
+func testStoreRoundTrip(t *testing.T, s Store) {
+	t.Helper()
+
+	if _, err := s.Load("settings.toml"); err != ErrNotStored {
+		t.Fatalf("Load of a missing key returned %v, want ErrNotStored", err)
+	}
+
+	data := []byte("NumTrackedDays = 7\n")
+	if err := s.Save("settings.toml", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save("1234.gob", []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	data[0] = 'X'
+
+	loaded, err := s.Load("settings.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(loaded) != "NumTrackedDays = 7\n" {
+		t.Errorf("Load returned %q, want the saved data", loaded)
+	}
+
+	if err = s.Save("settings.toml", []byte("NumTrackedDays = 14\n")); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, _ = s.Load("settings.toml"); string(loaded) != "NumTrackedDays = 14\n" {
+		t.Errorf("Load after overwriting returned %q", loaded)
+	}
+
+	keys, err := s.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(keys)
+	if want := []string{"1234.gob", "settings.toml"}; !slices.Equal(keys, want) {
+		t.Errorf("Keys returned %v, want %v", keys, want)
+	}
+
+	if err = s.Delete("1234.gob"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Delete("1234.gob"); err != nil {
+		t.Errorf("Delete of a missing key returned %v", err)
+	}
+	if _, err = s.Load("1234.gob"); err != ErrNotStored {
+		t.Errorf("Load of a deleted key returned %v, want ErrNotStored", err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	testStoreRoundTrip(t, &FileStore{Dir: t.TempDir()})
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStoreRoundTrip(t, NewMemoryStore())
+}
+
+func TestBoltStore(t *testing.T) {
+	s, err := openBoltStore(filepath.Join(t.TempDir(), "alice.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStoreRoundTrip(t, s)
+}
+
+func TestBackupStoreRoundTrip(t *testing.T) {
+	testStoreRoundTrip(t, &BackupStore{Store: NewMemoryStore()})
+}
+
+// generationsAgo returns the backup generation of the given number of hours ago.
+func generationsAgo(hours int) string {
+	return time.Now().UTC().Add(-time.Duration(hours) * time.Hour).Format(backupTimeFormat)
+}
+
+func TestBackupStoreRotation(t *testing.T) {
+	s := &BackupStore{Store: NewMemoryStore(), Generations: 3, Interval: time.Hour}
+
+	if err := s.Save("1234.gob", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if generations, _ := s.Backups("1234.gob"); len(generations) != 0 {
+		t.Fatalf("the first save created the backups %v, there was nothing to back up", generations)
+	}
+
+	old := []string{generationsAgo(5), generationsAgo(4), generationsAgo(3)}
+	for _, generation := range old {
+		if err := s.Store.Save(backupKey("1234.gob", generation), []byte(generation)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// backups of other keys are not touched
+	if err := s.Store.Save(backupKey("5678.gob", old[0]), []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Save("1234.gob", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	generations, err := s.Backups("1234.gob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generations) != 3 || generations[1] != old[2] || generations[2] != old[1] {
+		t.Fatalf("Backups returned %v, want a new generation followed by %s and %s", generations, old[2], old[1])
+	}
+	if backup, _ := s.Load(backupKey("1234.gob", generations[0])); string(backup) != "first" {
+		t.Errorf("the new generation contains %q, want the data before the save", backup)
+	}
+	if _, err = s.Load(backupKey("5678.gob", old[0])); err != nil {
+		t.Errorf("the backup of another key was deleted: %v", err)
+	}
+
+	// the newest generation is younger than the interval
+	if err = s.Save("1234.gob", []byte("third")); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := s.Backups("1234.gob"); !slices.Equal(again, generations) {
+		t.Errorf("a save within the interval changed the backups from %v to %v", generations, again)
+	}
+}
+
+func TestBackupStoreRestore(t *testing.T) {
+	s := &BackupStore{Store: NewMemoryStore(), Generations: 5, Interval: time.Hour}
+
+	old := generationsAgo(2)
+	if err := s.Store.Save(backupKey("1234.gob", old), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store.Save("1234.gob", []byte("current")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Restore("1234.gob", old); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := s.Load("1234.gob"); !bytes.Equal(data, []byte("old")) {
+		t.Errorf("Load after Restore returned %q, want the restored generation", data)
+	}
+
+	// the replaced data is backed up, so the restore can be undone
+	generations, err := s.Backups("1234.gob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generations) != 2 || generations[1] != old {
+		t.Fatalf("Backups returned %v, want a new generation followed by %s", generations, old)
+	}
+	if err = s.Restore("1234.gob", generations[0]); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := s.Load("1234.gob"); !bytes.Equal(data, []byte("current")) {
+		t.Errorf("Load after undoing the restore returned %q, want the data before the restore", data)
+	}
+
+	if err = s.Restore("1234.gob", generationsAgo(10)); err != ErrNotStored {
+		t.Errorf("Restore of a missing generation returned %v, want ErrNotStored", err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"regexp"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// trackNamePattern keeps track names usable in custom IDs and store keys.
+var trackNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// trackOption is the optional command option selecting a track, the default track if omitted.
+func trackOption() *discordgo.ApplicationCommandOption {
+	return &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        "track",
+		Description: "The track to use, the default track if omitted",
+		Required:    false,
+	}
+}
+
+// customIDTrack splits a custom ID like "name|<track>|<args>..." into the track and the given number of arguments.
+// Panels created before tracks existed have no track in their custom IDs, they belong to the default track.
+func customIDTrack(ids []string, args int) (string, []string, bool) {
+	switch len(ids) {
+	case args + 2:
+		return ids[1], ids[2:], true
+	case args + 1:
+		return DefaultTrack, ids[1:], true
+	default:
+		return "", nil, false
+	}
+}
+
+// commandTrack returns the track selected by the command options.
+func commandTrack(i *discordgo.InteractionCreate) string {
+	for _, option := range i.ApplicationCommandData().Options {
+		if option.Name == "track" {
+			return option.StringValue()
+		}
+	}
+	return DefaultTrack
+}
+
+func updateTrackMessage(s *discordgo.Session, i *discordgo.InteractionCreate, track string) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Components:      createTrackSettings(s, i.GuildID, track),
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+			Flags:           discordgo.MessageFlagsIsComponentsV2 | discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	rememberSettingsPanel(i, track)
+}
+
+func init() {
+	maps.Copy(messageComponents, map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+		"show_settings": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			updateSettingsMessage(s, i)
+		},
+		"edit_track": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			updateTrackMessage(s, i, i.MessageComponentData().Values[0])
+		},
+		"add_track": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseModal,
+				Data: &discordgo.InteractionResponseData{
+					Title: "Add Track",
+					Components: []discordgo.MessageComponent{
+						discordgo.ActionsRow{
+							Components: []discordgo.MessageComponent{
+								discordgo.TextInput{
+									Label:       "Name",
+									Placeholder: "Lowercase letters, digits, - and _ like help-channels",
+									Style:       discordgo.TextInputShort,
+									Required:    true,
+									MaxLength:   32,
+									CustomID:    "track_name",
+								},
+							},
+						},
+					},
+					CustomID: "add_track",
+				},
+			})
+			if err != nil {
+				log.Println(err)
+			}
+		},
+		"remove_track": func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			name, _, ok := customIDTrack(strings.Split(i.MessageComponentData().CustomID, "|"), 0)
+			if !ok || name == DefaultTrack {
+				return
+			}
+
+			err := updateGuildSettings(i.GuildID, func(settings *GuildSettings) error {
+				delete(settings.Tracks, name)
+				return nil
+			})
+			if err != nil {
+				return
+			}
+			removeTrackMetrics(i.GuildID, name)
+
+			updateSettingsMessage(s, i)
+		},
+	})
+
+	maps.Copy(modals, map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, ids []string){
+		"add_track": func(s *discordgo.Session, i *discordgo.InteractionCreate, ids []string) {
+			name := strings.ToLower(strings.TrimSpace(i.ModalSubmitData().Components[0].(*discordgo.ActionsRow).Components[0].(*discordgo.TextInput).Value))
+			if !trackNamePattern.MatchString(name) {
+				return
+			}
+			err := updateGuildSettings(i.GuildID, func(settings *GuildSettings) error {
+				if _, ok := settings.Tracks[name]; !ok {
+					settings.Tracks[name] = newTrackSettings()
+				}
+				return nil
+			})
+			if err != nil {
+				return
+			}
+
+			updateTrackMessage(s, i, name)
+		},
+	})
+}
+
+// trackDescription is shown in command responses of tracks other than the default track.
+func trackDescription(track string) string {
+	if track == DefaultTrack {
+		return ""
+	}
+	return fmt.Sprintf(" (%s)", track)
+}